@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Requests under these prefixes are logged at info level; static site assets
+// and probes only at debug level.
+var accessLogInfoPrefixes = []string{"/images/", "/thumbnails/", "/videos/", "/blurhash/", "/contactsheet/", "/download/", "/api/"}
+
+// accessNote carries what a handler wants added to its access log line.
+type accessNote struct {
+	cache string // resize outcome of an /images/ request
+}
+
+type accessNoteKey struct{}
+
+// noteCacheOutcome records the resize outcome of an /images/ request (hit,
+// miss, original, busy, rate_limited or error) for the access log.
+func noteCacheOutcome(r *http.Request, outcome string) {
+	if note, ok := r.Context().Value(accessNoteKey{}).(*accessNote); ok {
+		note.cache = outcome
+	}
+}
+
+// accessRecorder captures the status and size of a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (ar *accessRecorder) WriteHeader(status int) {
+	if ar.status == 0 {
+		ar.status = status
+	}
+	ar.ResponseWriter.WriteHeader(status)
+}
+
+func (ar *accessRecorder) Write(p []byte) (int, error) {
+	if ar.status == 0 {
+		ar.status = http.StatusOK
+	}
+	n, err := ar.ResponseWriter.Write(p)
+	ar.bytes += int64(n)
+	return n, err
+}
+
+func (ar *accessRecorder) Unwrap() http.ResponseWriter {
+	return ar.ResponseWriter
+}
+
+// withAccessLog logs one line per request with its method, path, status,
+// bytes, duration and client IP, plus the resize outcome for /images/.
+func withAccessLog(trustedProxies []string, h http.Handler) http.Handler {
+	trusted := parseTrustedProxies(trustedProxies)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := slog.LevelDebug
+		for _, prefix := range accessLogInfoPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				level = slog.LevelInfo
+				break
+			}
+		}
+		if !slog.Default().Enabled(r.Context(), level) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		note := &accessNote{}
+		ar := &accessRecorder{ResponseWriter: w}
+		h.ServeHTTP(ar, r.WithContext(context.WithValue(r.Context(), accessNoteKey{}, note)))
+		if ar.status == 0 {
+			ar.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.Int("status", ar.status),
+			slog.Int64("bytes", ar.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", clientIP(r, trusted)),
+		}
+		if note.cache != "" {
+			attrs = append(attrs, slog.String("cache", note.cache))
+		}
+		slog.LogAttrs(r.Context(), level, "Request", attrs...)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AlbumChild is a gallery listed on the album page of its parent folder.
+type AlbumChild struct {
+	Name      string
+	FolderSHA string
+	URL       string // URL of its post
+	CoverURL  string // /images/ URL of its cover, or of the first one below it; "" if none
+}
+
+// albumChildren returns the subfolders of path that hold media, directly or
+// further down, in natural order. It is nil unless enable_albums is set.
+func albumChildren(config Config, path string, entries []os.DirEntry) []AlbumChild {
+	if !config.EnableAlbums {
+		return nil
+	}
+	ignore := newIgnoreMatcher(config)
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !ignore.ignored(filepath.Join(path, entry.Name()), true) {
+			names = append(names, entry.Name())
+		}
+	}
+	sortNatural(names)
+
+	var children []AlbumChild
+	for _, name := range names {
+		dir := filepath.Join(path, name)
+		coverURL, ok := galleryCover(config, dir)
+		if ok {
+			folderSHA := sha1Hex(dir)
+			relPath, _ := filepath.Rel(config.WatchDir, dir)
+			children = append(children, AlbumChild{Name: name, FolderSHA: folderSHA, URL: postURL(config, relPath, folderSHA), CoverURL: coverURL})
+		}
+	}
+	return children
+}
+
+// galleryCover reports whether dir is a gallery, a folder with media or with
+// a gallery below it, and returns the URL of its cover.
+func galleryCover(config Config, dir string) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	images, videos := classifyMedia(config, newIgnoreMatcher(config), dir, entries, nil, nil)
+	if len(images)+len(videos) > 0 {
+		cover := coverImage(images)
+		if cover == "" {
+			return "", true
+		}
+		return "/images/" + sha1Hex(dir) + "/" + url.QueryEscape(cover), true
+	}
+	children := albumChildren(config, dir, entries)
+	if len(children) == 0 {
+		return "", false
+	}
+	return children[0].CoverURL, true
+}
+
+// parentSHA returns the folder SHA of the folder containing path, "" for the
+// folders directly in WatchDir.
+func parentSHA(config Config, path string) string {
+	parent := filepath.Dir(path)
+	if parent == filepath.Clean(config.WatchDir) {
+		return ""
+	}
+	return sha1Hex(parent)
+}
+
+// folderHash is the content hash stored for a folder: that of its media, or
+// for an album without media, that of its children and their covers.
+func folderHash(config Config, path string, entries []os.DirEntry, images, videos []string) string {
+	description := readDescription(path)
+	if len(images)+len(videos) > 0 {
+		return contentHash(images, videos, description)
+	}
+	return albumHash(albumChildren(config, path, entries), description)
+}
+
+func albumHash(children []AlbumChild, description string) string {
+	lines := make([]string, len(children))
+	for i, child := range children {
+		lines[i] = child.FolderSHA + " " + child.CoverURL
+	}
+	return contentHash(nil, lines, description)
+}
+
+// writeAlbum writes the album page of a folder without media of its own,
+// linking to the galleries below it. Albums are recorded with no files.
+func writeAlbum(path string, config Config, store postStore, children []AlbumChild, rebuild bool) {
+	rel_path, err := filepath.Rel(config.WatchDir, path)
+	if err != nil {
+		slog.Error("Getting relative path failed", "path", path, "err", err)
+		return
+	}
+	postname := filepath.Base(path)
+	categories := getCategories(rel_path)
+	tags := getTags(categories, postname)
+	folderSHA := sha1Hex(path)
+
+	postFile := folderSHA + ".md"
+	postDir, err := makePostDir(config, rel_path)
+	if err != nil {
+		slog.Error("Creating post directory failed", "err", err)
+		return
+	}
+	postPath := filepath.Join(postDir, postFile)
+
+	date := postDate(config, path, nil)
+	description := readDescription(path)
+	slog.Info("Generating album", "sha", folderSHA, "path", path, "children", len(children))
+	mdContent := generateAlbumMarkdown(currentTemplate(), topCategory(categories), postname, rel_path, folderSHA, tags, date, description, children)
+
+	oldContent, _ := os.ReadFile(postPath)
+	if err := os.WriteFile(postPath, []byte(mdContent), 0644); err != nil {
+		slog.Error("Writing markdown failed", "sha", folderSHA, "err", err)
+		return
+	}
+
+	store.AddPost(Post{
+		FolderSHA:   folderSHA,
+		PostFile:    postFile,
+		Category:    strings.Join(categories, "/"),
+		Tags:        tags,
+		RelPath:     rel_path,
+		ParentSHA:   parentSHA(config, path),
+		ContentHash: albumHash(children, description),
+		CreatedAt:   date,
+	})
+
+	if rebuild {
+		rebuildForPost(config, postPath, string(oldContent), mdContent)
+	}
+}
+
+// refreshAlbums rewrites the albums above path whose children changed, and
+// reports whether it did. Without enable_albums it does nothing.
+func refreshAlbums(config Config, db *sql.DB, ip *ImageProcessor, path string) bool {
+	if !config.EnableAlbums {
+		return false
+	}
+	root := filepath.Clean(config.WatchDir)
+	ignore := newIgnoreMatcher(config)
+	changed := false
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if ignore.ignored(dir, true) {
+			break
+		}
+		if pollFolder(config, db, ip, ignore, dir) {
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 500
+)
+
+// apiPost is the JSON form of a Post.
+type apiPost struct {
+	FolderSHA string    `json:"folder_sha"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	Tags      []string  `json:"tags"`
+	NFile     int       `json:"n_file"`
+	Cover     string    `json:"cover"`
+	CoverURL  string    `json:"cover_url,omitempty"`
+	URL       string    `json:"url"`
+	ParentSHA string    `json:"parent_sha,omitempty"` // containing album, see /api/posts/{sha1}/breadcrumbs
+	Album     bool      `json:"album"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiPostList struct {
+	Posts    []apiPost `json:"posts"`
+	Page     int       `json:"page"`
+	PerPage  int       `json:"per_page"`
+	Total    int       `json:"total"`
+	NextPage *int      `json:"next_page"`
+}
+
+func newAPIPost(p Post) apiPost {
+	post := apiPost{
+		FolderSHA: p.FolderSHA,
+		Name:      filepath.Base(p.RelPath),
+		Category:  p.Category,
+		Tags:      p.Tags,
+		NFile:     p.NFile,
+		Cover:     p.Cover,
+		URL:       postURL(currentConfig(), p.RelPath, strings.TrimSuffix(p.PostFile, ".md")),
+		ParentSHA: p.ParentSHA,
+		Album:     p.NFile == 0,
+		CreatedAt: p.CreatedAt,
+	}
+	if post.Tags == nil {
+		post.Tags = []string{}
+	}
+	if p.Cover != "" {
+		post.CoverURL = "/images/" + p.FolderSHA + "/" + url.QueryEscape(p.Cover)
+	}
+	return post
+}
+
+// handleListPosts serves GET /api/posts?page=1&per_page=50[&order=asc].
+func handleListPosts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page, err := parsePositiveParam(r.URL.Query().Get("page"), 1)
+		if err != nil {
+			http.Error(w, "Invalid page parameter", http.StatusBadRequest)
+			return
+		}
+		perPage, err := parsePositiveParam(r.URL.Query().Get("per_page"), apiDefaultPerPage)
+		if err != nil || perPage > apiMaxPerPage {
+			http.Error(w, "Invalid per_page parameter", http.StatusBadRequest)
+			return
+		}
+		order := r.URL.Query().Get("order")
+		if order != "" && order != "asc" && order != "desc" {
+			http.Error(w, "Invalid order parameter", http.StatusBadRequest)
+			return
+		}
+
+		posts, total, err := ListPosts(db, (page-1)*perPage, perPage, order == "asc")
+		if err != nil {
+			slog.Error("Listing posts failed", "err", err)
+			http.Error(w, "Error listing posts", http.StatusInternalServerError)
+			return
+		}
+
+		resp := apiPostList{
+			Posts:   make([]apiPost, len(posts)),
+			Page:    page,
+			PerPage: perPage,
+			Total:   total,
+		}
+		for i, p := range posts {
+			resp.Posts[i] = newAPIPost(p)
+		}
+		if page*perPage < total {
+			next := page + 1
+			resp.NextPage = &next
+		}
+		writeJSON(w, resp)
+	}
+}
+
+type apiSiblings struct {
+	Prev *apiPost `json:"prev"`
+	Next *apiPost `json:"next"`
+}
+
+// handlePostSiblings serves GET /api/posts/{sha1}/siblings[?order=path] with
+// the posts before and after a post, by date or by folder path.
+func handlePostSiblings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderSHA, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/posts/"), "/siblings")
+		if !ok || folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		order := r.URL.Query().Get("order")
+		if order != "" && order != "date" && order != "path" {
+			http.Error(w, "Invalid order parameter", http.StatusBadRequest)
+			return
+		}
+
+		prev, next, err := PostSiblings(db, folderSHA, order == "path")
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			slog.Error("Finding sibling posts failed", "sha", folderSHA, "err", err)
+			http.Error(w, "Error finding sibling posts", http.StatusInternalServerError)
+			return
+		}
+
+		var resp apiSiblings
+		if prev != nil {
+			post := newAPIPost(*prev)
+			resp.Prev = &post
+		}
+		if next != nil {
+			post := newAPIPost(*next)
+			resp.Next = &post
+		}
+		writeJSON(w, resp)
+	}
+}
+
+// apiBreadcrumb is one album above a post, outermost first.
+type apiBreadcrumb struct {
+	FolderSHA string `json:"folder_sha"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+}
+
+// Deepest folder nesting followed by /breadcrumbs, in case of a parent cycle.
+const maxBreadcrumbDepth = 64
+
+// handleBreadcrumbs serves GET /api/posts/{sha1}/breadcrumbs with the
+// albums containing a post, following parent_sha up to the first folder that
+// has no post.
+func handleBreadcrumbs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderSHA, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/posts/"), "/breadcrumbs")
+		if !ok || folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		post, err := GetPost(db, folderSHA)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			slog.Error("Loading post failed", "sha", folderSHA, "err", err)
+			http.Error(w, "Error loading post", http.StatusInternalServerError)
+			return
+		}
+
+		crumbs := []apiBreadcrumb{}
+		for parent := post.ParentSHA; parent != "" && len(crumbs) < maxBreadcrumbDepth; {
+			p, err := GetPost(db, parent)
+			if err != nil {
+				if !errors.Is(err, sql.ErrNoRows) {
+					slog.Error("Loading parent post failed", "sha", parent, "err", err)
+				}
+				break
+			}
+			ap := newAPIPost(p)
+			crumbs = append(crumbs, apiBreadcrumb{FolderSHA: p.FolderSHA, Name: ap.Name, URL: ap.URL})
+			parent = p.ParentSHA
+		}
+		slices.Reverse(crumbs)
+		writeJSON(w, crumbs)
+	}
+}
+
+// Posts drawn per /api/random request, in case some have no photo left.
+const randomCandidates = 5
+
+// handleRandomImage serves GET /api/random[?category=...] by redirecting to
+// a random photo of a random post. Other query parameters, such as w, are
+// passed on to the /images/ URL.
+func handleRandomImage(config Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		category := strings.Trim(query.Get("category"), "/")
+		query.Del("category")
+
+		posts, err := RandomPosts(db, category, randomCandidates)
+		if err != nil {
+			slog.Error("Picking random posts failed", "err", err)
+			http.Error(w, "Error picking a post", http.StatusInternalServerError)
+			return
+		}
+		for _, p := range posts {
+			entries, err := os.ReadDir(filepath.Join(config.ImageRoot, p.RelPath))
+			if err != nil {
+				continue
+			}
+			images, _ := classifyMedia(config, newIgnoreMatcher(config), filepath.Join(config.WatchDir, p.RelPath), entries, nil, nil)
+			if len(images) == 0 {
+				continue
+			}
+			target := "/images/" + p.FolderSHA + "/" + url.QueryEscape(images[rand.IntN(len(images))])
+			if len(query) > 0 {
+				target += "?" + query.Encode()
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Ready  bool   `json:"ready"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleHealth serves GET /healthz: 200 once the initial scan finished, the
+// database answers and the Hugo output exists, 503 otherwise.
+func handleHealth(config Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{Status: "ok", Ready: ready.Load()}
+		var one int
+		if err := db.QueryRow("SELECT 1").Scan(&one); err != nil {
+			status.Error = "database unreachable: " + err.Error()
+		} else if info, err := os.Stat(config.HugoOutDir); err != nil || !info.IsDir() {
+			status.Error = "hugo output directory missing"
+		} else if !status.Ready {
+			status.Error = "initial scan running"
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Error != "" {
+			status.Status = "unavailable"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		writeJSON(w, status)
+	}
+}
+
+// handleTags serves GET /api/tags with every tag and its number of posts,
+// most used first.
+func handleTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tags, err := TagCounts(db)
+		if err != nil {
+			slog.Error("Counting tags failed", "err", err)
+			http.Error(w, "Error counting tags", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tags)
+	}
+}
+
+// parsePositiveParam parses an optional query value that must be >= 1.
+func parsePositiveParam(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Writing JSON response failed", "err", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long the archetype files must stay unchanged before they are reloaded;
+// editors often write a file in several steps.
+const templateReloadDelay = 500 * time.Millisecond
+
+// liveTemplate is the archetype set posts are rendered with.
+var liveTemplate atomic.Pointer[template.Template]
+
+func currentTemplate() *template.Template {
+	return liveTemplate.Load()
+}
+
+// watchTemplates reloads the archetypes whenever one of them changes on disk,
+// until ctx is cancelled. The folders holding them are watched rather than
+// the files, so editors that save by replacing the file are followed too.
+func watchTemplates(ctx context.Context, config Config, db *sql.DB) {
+	paths := map[string]bool{filepath.Clean(config.Archetype): true}
+	for _, path := range config.CategoryArchetypes {
+		paths[filepath.Clean(path)] = true
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Watching archetypes failed", "err", err)
+		return
+	}
+	defer watcher.Close()
+	for path := range paths {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			slog.Error("Watching archetype failed", "path", path, "err", err)
+		}
+	}
+
+	var timer *time.Timer
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !paths[filepath.Clean(event.Name)] || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if timer == nil {
+				timer = time.AfterFunc(templateReloadDelay, func() { reloadTemplate(config, db) })
+			} else {
+				timer.Reset(templateReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Archetype watcher error", "err", err)
+		}
+	}
+}
+
+// reloadTemplate parses the archetypes again and rewrites every post with
+// them. A template that fails to parse is logged and the last good one kept.
+func reloadTemplate(config Config, db *sql.DB) {
+	tmpl, err := loadTemplate(config)
+	if err != nil {
+		slog.Error("Reloading archetype failed, keeping the last good one", "err", err)
+		return
+	}
+	liveTemplate.Store(tmpl)
+	slog.Info("Archetype changed, regenerating posts")
+	posts := regeneratePosts(config, db)
+	slog.Info("Regenerated posts with the new archetype", "posts", posts)
+	rebuildHugo(config)
+}
+
+// regeneratePosts rewrites the markdown of every post and returns how many
+// it rewrote.
+func regeneratePosts(config Config, db *sql.DB) int {
+	posts := 0
+	for _, relPath := range LoadFolderMap(db) {
+		path := filepath.Join(config.WatchDir, relPath)
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			// Housekeeping removes the posts of vanished folders
+			continue
+		}
+		images, videos := classifyMedia(config, newIgnoreMatcher(config), path, entries, nil, nil)
+		updatePost(dbStore{db}, path, images, videos, config)
+		posts++
+	}
+	return posts
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authEnabled reports whether basic auth credentials are configured.
+func authEnabled(config Config) bool {
+	return config.AuthUser != ""
+}
+
+// withBasicAuth rejects requests without the configured credentials. The
+// password is checked against auth_pass_bcrypt when set, else auth_pass.
+func withBasicAuth(config Config, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !checkCredentials(config, user, pass) {
+			if ok {
+				slog.Debug("Failed login", "user", user, "remote", r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="hugo_gallery", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withCredentials serves h only when basic auth is configured, which then
+// already guards the whole server, and answers 403 otherwise.
+func withCredentials(config Config, h http.Handler) http.Handler {
+	if authEnabled(config) {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden: configure auth_user to use this endpoint", http.StatusForbidden)
+	})
+}
+
+// checkCredentials compares in constant time; hashing first keeps the
+// comparison independent of the input lengths.
+func checkCredentials(config Config, user, pass string) bool {
+	userHash := sha256.Sum256([]byte(user))
+	wantHash := sha256.Sum256([]byte(config.AuthUser))
+	userOK := subtle.ConstantTimeCompare(userHash[:], wantHash[:]) == 1
+
+	var passOK bool
+	if config.AuthPassBcrypt != "" {
+		passOK = bcrypt.CompareHashAndPassword([]byte(config.AuthPassBcrypt), []byte(pass)) == nil
+	} else {
+		passHash := sha256.Sum256([]byte(pass))
+		wantHash := sha256.Sum256([]byte(config.AuthPass))
+		passOK = subtle.ConstantTimeCompare(passHash[:], wantHash[:]) == 1
+	}
+	return userOK && passOK
+}
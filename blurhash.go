@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	blurhashSampleWidth = 32 // sources are downscaled to this width first
+	blurhashXComponents = 4
+	blurhashYComponents = 3
+)
+
+func blurhash_path(originalPath string, cacheDir string, version string) string {
+	hash := cache_image_hash(originalPath, ImageOptions{Width: blurhashSampleWidth, SourceVersion: version})
+	return cacheFile(cacheDir, fmt.Sprintf("%s.blurhash", hash))
+}
+
+// Blurhash returns the blurhash string of the image at srcRelPath. It is
+// computed under the same concurrency limit as resizes and cached as a small
+// text file next to the thumbnails.
+func (ip *ImageProcessor) Blurhash(ctx context.Context, srcRelPath string) (string, error) {
+	srcPath := filepath.Join(ip.resourceDir, srcRelPath)
+	cachedPath := blurhash_path(srcRelPath, ip.cacheDir, ip.sourceVersion(srcRelPath))
+	path, err := ip.generate(ctx, cachedPath, "", func() error {
+		return ip.computeBlurhash(srcPath, cachedPath)
+	})
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (ip *ImageProcessor) computeBlurhash(srcPath, destPath string) error {
+	src, err := ip.openSource(srcPath, true)
+	if err != nil {
+		return err
+	}
+
+	small := imaging.Resize(src, blurhashSampleWidth, 0, imaging.Box)
+	hash, err := blurhash.Encode(blurhashXComponents, blurhashYComponents, small)
+	if err != nil {
+		return fmt.Errorf("failed to encode blurhash: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return os.WriteFile(destPath, []byte(hash), 0644)
+}
@@ -1,45 +1,544 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 
 	"gopkg.in/ini.v1"
 )
 
 type Config struct {
-	WatchDir                    string   // Directory of photos/videos to watch
-	ImageRoot                   string   // Root directory for image URLs
-	ImageCacheDir               string   // Directory to store cached resized images
-	ImageCacheExpirationMinutes int      // Minutes before cached images expire
-	HugoOutDir                  string   // Directory where Hugo outputs the static site
-	PhotoExts                   []string // Supported photo file extensions
-	VideoExts                   []string // Supported video file extensions
-	ServerPort                  string   // Port for the HTTP server
-	SqlitePath                  string   // Path to the SQLite database file
-	HugoPath                    string   // Path to the Hugo binary
-	Archetype                   string   // Path to the Hugo archetype template
-	ContentDir                  string   // Path to the Hugo content directory relative to HugoOutDir
-	Verbose                     bool     // Verbose logging
+	WatchDir                    string            `ini:"watched_folder"`                 // Directory of photos/videos to watch
+	ImageRoot                   string            `ini:"image_root"`                     // Root directory for image URLs
+	ImageCacheDir               string            `ini:"image_cache_folder"`             // Directory to store cached resized images
+	ImageCacheExpirationMinutes int               `ini:"image_cache_expiration_minutes"` // Minutes before cached images expire
+	CacheCleanupIntervalMinutes int               `ini:"cache_cleanup_interval_minutes"` // Minutes between removals of expired cache files
+	HugoOutDir                  string            `ini:"hugo_built_out_folder"`          // Directory where Hugo outputs the static site
+	PhotoExts                   []string          `ini:"photo_extensions"`               // Supported photo file extensions
+	VideoExts                   []string          `ini:"video_extensions"`               // Supported video file extensions
+	SniffContentType            bool              `ini:"sniff_content_type"`             // Classify files without an extension by their content
+	MediaSort                   string            `ini:"media_sort"`                     // Order of files in a post: name, name_natural, mtime_asc or mtime_desc
+	MaxFilesPerPost             int               `ini:"max_files_per_post"`             // Most photos and videos listed in a post, 0 for no limit
+	EnableAlbums                bool              `ini:"enable_albums"`                  // Give folders with only subfolders an album page linking them
+	ServerPort                  string            `ini:"http_port"`                      // Port for the HTTP server
+	BindAddress                 string            `ini:"bind_address"`                   // IP or host name the listeners bind to, "" for all interfaces
+	SqlitePath                  string            `ini:"sqlite_db_path"`                 // Path to the SQLite database file
+	HugoPath                    string            `ini:"hugo_bin_path"`                  // Path to the Hugo binary
+	Archetype                   string            `ini:"hugo_archetype"`                 // Path to the Hugo archetype template
+	CategoryArchetypes          map[string]string `ini:"category_archetypes"`            // Archetype per top-level category, overriding hugo_archetype
+	ContentDir                  string            `ini:"hugo_content_dir"`               // Path to the Hugo content directory relative to HugoOutDir
+	PostLayout                  string            `ini:"post_layout"`                    // Where posts are written: post (flat) or category (nested)
+	Verbose                     bool              `ini:"verbose"`                        // Verbose logging
+	HugoPartialRebuild          bool              `ini:"hugo_partial_rebuild"`           // Render only changed pages via Hugo segments
+	HugoConfig                  string            `ini:"hugo_config"`                    // Hugo site config file, detected in the site root when empty
+	HugoArgs                    []string          `ini:"hugo_args"`                      // Extra arguments appended to every hugo command
+	HugoEnv                     []string          `ini:"hugo_env"`                       // KEY=VALUE variables added to Hugo's environment
+	OutputFormat                string            `ini:"output_format"`                  // Default format for resized images, empty keeps the source format
+	JPEGQuality                 int               `ini:"jpeg_quality"`                   // Default JPEG quality (1-100) for resized images
+	StripMetadata               bool              `ini:"strip_metadata"`                 // Never serve photos with EXIF/IPTC/XMP metadata
+	CorruptImagePlaceholder     string            `ini:"corrupt_image_placeholder"`      // Image served for photos that cannot be decoded, a gray box when empty
+	DateFromEXIF                bool              `ini:"date_from_exif"`                 // Date posts by the earliest EXIF capture date instead of the folder mtime
+	FFmpegPath                  string            `ini:"ffmpeg_bin_path"`                // Path to the ffmpeg binary used for video thumbnails
+	MaxCacheBytes               int64             `ini:"max_cache_bytes"`                // Evict least recently used cache files above this size, 0 for no limit
+	ImageCacheSharding          bool              `ini:"image_cache_sharding"`           // Spread cache files over subdirectories by hash prefix
+	ImageCacheKeySource         bool              `ini:"image_cache_key_source"`         // Name cached variants after the source's size and mtime too
+	ImageOpenRetries            int               `ini:"image_open_retries"`             // Retries of a source image that failed to read, e.g. on a busy NFS mount
+	AllowUpscale                bool              `ini:"allow_upscale"`                  // Enlarge images when the requested size exceeds the source
+	PrecomputeWidths            []int             `ini:"precompute_widths"`              // Thumbnail widths generated in the background for new folders
+	AllowedWidths               []int             `ini:"allowed_widths"`                 // Widths requests are snapped to, empty to allow any
+	WarmCacheManifest           string            `ini:"warm_cache_manifest"`            // File of "path width" lines pregenerated at startup
+	ImageMaxConcurrent          int               `ini:"image_max_concurrent"`           // Maximum number of concurrent image jobs
+	ResizeFilter                string            `ini:"resize_filter"`                  // Resampling filter: lanczos, catmullrom, linear or box
+	IdleSecond                  int               `ini:"idle_second"`                    // Seconds without changes before Hugo rebuilds
+	RebuildMinInterval          int               `ini:"rebuild_min_interval"`           // Minimum seconds between full Hugo builds, 0 for no minimum
+	IgnorePatterns              []string          `ini:"ignore_patterns"`                // Names of files and folders skipped everywhere
+	EnableGzip                  bool              `ini:"enable_gzip"`                    // Compress text responses of the Hugo site
+	HTTPReadTimeoutSeconds      int               `ini:"http_read_timeout_seconds"`      // Seconds to read a request, 0 for no limit
+	HTTPWriteTimeoutSeconds     int               `ini:"http_write_timeout_seconds"`     // Seconds to write a response, except videos and downloads; 0 for no limit
+	HTTPIdleTimeoutSeconds      int               `ini:"http_idle_timeout_seconds"`      // Seconds an idle keep-alive connection stays open, 0 for no limit
+	TLSCert                     string            `ini:"tls_cert"`                       // Certificate file; HTTPS is served when set
+	TLSKey                      string            `ini:"tls_key"`                        // Private key file for TLSCert
+	HTTPRedirectPort            string            `ini:"http_redirect_port"`             // Port redirecting plain HTTP to HTTPS, "" to disable
+	AuthUser                    string            `ini:"auth_user"`                      // Basic auth user name, "" to disable auth
+	AuthPass                    string            `ini:"auth_pass"`                      // Basic auth password in plain text
+	AuthPassBcrypt              string            `ini:"auth_pass_bcrypt"`               // Basic auth password as a bcrypt hash, preferred over AuthPass
+	ImageRatePerSec             float64           `ini:"image_rate_per_sec"`             // Image requests per second allowed per client IP, 0 to disable
+	ImageRateBurst              int               `ini:"image_rate_burst"`               // Image requests a client may make at once
+	TrustedProxies              []string          `ini:"trusted_proxy"`                  // Proxy IPs/CIDRs whose X-Forwarded-For is trusted
+	NegotiateWebP               bool              `ini:"negotiate_webp"`                 // Serve resized images as WebP when the Accept header allows
+	ImageCacheControlSeconds    int               `ini:"image_cache_control_seconds"`    // Cache-Control max-age of resized images, 0 to send none
+	DBMaintenanceHours          int               `ini:"db_maintenance_hours"`           // Hours between SQLite integrity checks and VACUUM, 0 to disable
+	LogLevel                    string            `ini:"log_level"`                      // debug, info, warn or error; defaults to debug when verbose is set
+	LogFormat                   string            `ini:"log_format"`                     // text or json
+	WatchMode                   string            `ini:"watch_mode"`                     // fsnotify, poll, or auto to poll when watching fails
+	PollIntervalSeconds         int               `ini:"poll_interval_seconds"`          // Seconds between rescans when polling
+	TagSkipWords                []string          `ini:"tag_skip_words"`                 // Words never used as tags, including those of tag_skip_words_file
+	TagSkipWordsFile            string            `ini:"tag_skip_words_file"`            // File with more skip words, one per line
+	EnableJieba                 bool              `ini:"enable_jieba"`                   // Tag posts with the words Jieba cuts from the folder name
+	TagLanguage                 string            `ini:"tag_language"`                   // Tokenizer for folder names: zh, ja, en or auto
+	MaxTags                     int               `ini:"max_tags"`                       // Most tags per post, 0 for no limit
+	JiebaUserWords              []string          `ini:"jieba_user_words"`               // Words Jieba must not split
+	JiebaUserDict               string            `ini:"jieba_user_dict"`                // Jieba user dictionary file
+	EnableMetrics               bool              `ini:"enable_metrics"`                 // Serve Prometheus metrics at /metrics
+	MetricsPort                 string            `ini:"metrics_port"`                   // Separate port for /metrics, "" to serve it on http_port
+	FeedSize                    int               `ini:"feed_size"`                      // Newest posts listed in /feed.xml
+	FeedFormat                  string            `ini:"feed_format"`                    // rss or atom
+	FeedTitle                   string            `ini:"feed_title"`                     // Title of /feed.xml
 }
 
-func LoadConfig(path string) Config {
+// Prefix of the environment variables overriding config.ini keys.
+const envPrefix = "GALLERY_"
+
+// applyEnvOverrides replaces [main] keys with environment variables named
+// GALLERY_ plus the upper-cased key, e.g. GALLERY_HTTP_PORT for http_port.
+// Variables that are unset leave the ini value alone; set but empty ones
+// clear it.
+func applyEnvOverrides(cfg *ini.File) {
+	seen := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("ini")
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		name := envPrefix + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(name); ok {
+			cfg.Section("main").Key(key).SetValue(value)
+			slog.Info("Config set from environment", "key", key, "var", name)
+		}
+	}
+}
+
+// flagOverrides maps config.ini keys to the values given for them on the
+// command line. They take precedence over the environment and the ini file.
+var flagOverrides = make(map[string]string)
+
+// checkHugoBinary makes LoadConfig require hugo_bin_path. main clears it for
+// --dry-run and --reindex, which never run Hugo.
+var checkHugoBinary = true
+
+// applyFlagOverrides replaces [main] keys with their command-line values.
+func applyFlagOverrides(cfg *ini.File) {
+	for key, value := range flagOverrides {
+		cfg.Section("main").Key(key).SetValue(value)
+		slog.Info("Config set from command line", "key", key)
+	}
+}
+
+// LoadConfig reads path and validates it, returning every problem found
+// joined into one error.
+func LoadConfig(path string) (Config, error) {
 	cfg, err := ini.Load(path)
 	if err != nil {
-		log.Fatalf("Fail to read file: %v", err)
+		return Config{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	applyEnvOverrides(cfg)
+	applyFlagOverrides(cfg)
+	var problems []error
+	invalid := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	outputFormat, err := parseOutputFormat(cfg.Section("main").Key("output_format").String())
+	if err != nil {
+		invalid("invalid output_format: %v", err)
+	}
+	jpegQuality := cfg.Section("main").Key("jpeg_quality").MustInt(85)
+	if jpegQuality < 1 || jpegQuality > 100 {
+		invalid("invalid jpeg_quality %d: must be between 1 and 100", jpegQuality)
+	}
+	precomputeWidths := cfg.Section("main").Key("precompute_widths").Ints(",")
+	for _, width := range precomputeWidths {
+		if width <= 0 {
+			invalid("invalid precompute_widths %d: must be positive", width)
+		}
+	}
+	allowedWidths := cfg.Section("main").Key("allowed_widths").Ints(",")
+	for _, width := range allowedWidths {
+		if width <= 0 {
+			invalid("invalid allowed_widths %d: must be positive", width)
+		}
+	}
+	sort.Ints(allowedWidths)
+	imageMaxConcurrent := cfg.Section("main").Key("image_max_concurrent").MustInt(runtime.NumCPU())
+	if imageMaxConcurrent < 1 {
+		invalid("invalid image_max_concurrent %d: must be at least 1", imageMaxConcurrent)
+	}
+	resizeFilter := strings.ToLower(cfg.Section("main").Key("resize_filter").MustString("lanczos"))
+	if _, ok := resampleFilters[resizeFilter]; !ok {
+		invalid("invalid resize_filter %q: must be lanczos, catmullrom, linear or box", resizeFilter)
+	}
+	cacheCleanupIntervalMinutes := cfg.Section("main").Key("cache_cleanup_interval_minutes").MustInt(10080)
+	if cacheCleanupIntervalMinutes < 1 {
+		invalid("invalid cache_cleanup_interval_minutes %d: must be at least 1", cacheCleanupIntervalMinutes)
+	}
+	idleSecond := cfg.Section("main").Key("idle_second").MustInt(5)
+	if idleSecond < 0 {
+		invalid("invalid idle_second %d: must not be negative", idleSecond)
+	}
+	ignorePatterns := defaultIgnorePatterns
+	if cfg.Section("main").HasKey("ignore_patterns") {
+		ignorePatterns = cfg.Section("main").Key("ignore_patterns").Strings(",")
+	}
+	tagSkipWords := defaultTagSkipWords
+	if cfg.Section("main").HasKey("tag_skip_words") {
+		tagSkipWords = cfg.Section("main").Key("tag_skip_words").Strings(",")
+	}
+	tagSkipWordsFile := cfg.Section("main").Key("tag_skip_words_file").String()
+	if tagSkipWordsFile != "" {
+		words, err := readWordList(tagSkipWordsFile)
+		if err != nil {
+			invalid("tag_skip_words_file %q is not readable: %v", tagSkipWordsFile, err)
+		}
+		tagSkipWords = append(append([]string(nil), tagSkipWords...), words...)
+	}
+	mediaSort := cfg.Section("main").Key("media_sort").MustString("name_natural")
+	if !mediaSorts[mediaSort] {
+		invalid("invalid media_sort %q: must be name, name_natural, mtime_asc or mtime_desc", mediaSort)
+	}
+	imageOpenRetries := cfg.Section("main").Key("image_open_retries").MustInt(2)
+	if imageOpenRetries < 0 || imageOpenRetries > 10 {
+		invalid("invalid image_open_retries %d: must be between 0 and 10", imageOpenRetries)
+	}
+	postLayout := cfg.Section("main").Key("post_layout").MustString(postLayoutFlat)
+	if postLayout != postLayoutFlat && postLayout != postLayoutCategory {
+		invalid("invalid post_layout %q: must be post or category", postLayout)
+	}
+	tagLanguage := cfg.Section("main").Key("tag_language").MustString("zh")
+	if _, ok := tokenizers[tagLanguage]; !ok && tagLanguage != "auto" {
+		invalid("invalid tag_language %q: must be zh, ja, en or auto", tagLanguage)
+	}
+	maxTags := cfg.Section("main").Key("max_tags").MustInt(0)
+	if maxTags < 0 {
+		invalid("invalid max_tags %d: must not be negative", maxTags)
+	}
+	jiebaUserWords := defaultJiebaUserWords
+	if cfg.Section("main").HasKey("jieba_user_words") {
+		jiebaUserWords = cfg.Section("main").Key("jieba_user_words").Strings(",")
+	}
+	categoryArchetypes := make(map[string]string)
+	for _, entry := range cfg.Section("main").Key("category_archetypes").Strings(",") {
+		category, path, ok := strings.Cut(entry, "=")
+		category, path = strings.TrimSpace(category), strings.TrimSpace(path)
+		if !ok || category == "" || path == "" {
+			invalid("invalid category_archetypes entry %q: must be category=path", entry)
+			continue
+		}
+		categoryArchetypes[category] = path
+	}
+	hugoEnv := cfg.Section("main").Key("hugo_env").Strings(",")
+	for _, entry := range hugoEnv {
+		if name, _, ok := strings.Cut(entry, "="); !ok || name == "" {
+			invalid("invalid hugo_env entry %q: must be KEY=VALUE", entry)
+		}
+	}
+	rebuildMinInterval := cfg.Section("main").Key("rebuild_min_interval").MustInt(0)
+	if rebuildMinInterval < 0 {
+		invalid("invalid rebuild_min_interval %d: must not be negative", rebuildMinInterval)
+	}
+	feedSize := cfg.Section("main").Key("feed_size").MustInt(20)
+	if feedSize < 1 {
+		invalid("invalid feed_size %d: must be at least 1", feedSize)
+	}
+	feedFormat := cfg.Section("main").Key("feed_format").MustString("rss")
+	if feedFormat != "rss" && feedFormat != "atom" {
+		invalid("invalid feed_format %q: must be rss or atom", feedFormat)
+	}
+	httpReadTimeoutSeconds := cfg.Section("main").Key("http_read_timeout_seconds").MustInt(30)
+	if httpReadTimeoutSeconds < 0 {
+		invalid("invalid http_read_timeout_seconds %d: must not be negative", httpReadTimeoutSeconds)
+	}
+	httpWriteTimeoutSeconds := cfg.Section("main").Key("http_write_timeout_seconds").MustInt(120)
+	if httpWriteTimeoutSeconds < 0 {
+		invalid("invalid http_write_timeout_seconds %d: must not be negative", httpWriteTimeoutSeconds)
+	}
+	httpIdleTimeoutSeconds := cfg.Section("main").Key("http_idle_timeout_seconds").MustInt(120)
+	if httpIdleTimeoutSeconds < 0 {
+		invalid("invalid http_idle_timeout_seconds %d: must not be negative", httpIdleTimeoutSeconds)
+	}
+	imageCacheControlSeconds := cfg.Section("main").Key("image_cache_control_seconds").MustInt(31536000)
+	if imageCacheControlSeconds < 0 {
+		invalid("invalid image_cache_control_seconds %d: must not be negative", imageCacheControlSeconds)
+	}
+	maxFilesPerPost := cfg.Section("main").Key("max_files_per_post").MustInt(0)
+	if maxFilesPerPost < 0 {
+		invalid("invalid max_files_per_post %d: must not be negative", maxFilesPerPost)
+	}
+	tlsCert := cfg.Section("main").Key("tls_cert").String()
+	tlsKey := cfg.Section("main").Key("tls_key").String()
+	if (tlsCert == "") != (tlsKey == "") {
+		invalid("invalid TLS config: tls_cert and tls_key must be set together")
+	}
+	authUser := cfg.Section("main").Key("auth_user").String()
+	authPass := cfg.Section("main").Key("auth_pass").String()
+	authPassBcrypt := cfg.Section("main").Key("auth_pass_bcrypt").String()
+	if authUser != "" && authPass == "" && authPassBcrypt == "" {
+		invalid("invalid auth config: auth_user requires auth_pass or auth_pass_bcrypt")
 	}
-	return Config{
+	if authUser == "" && (authPass != "" || authPassBcrypt != "") {
+		invalid("invalid auth config: auth_pass requires auth_user")
+	}
+	imageRatePerSec := cfg.Section("main").Key("image_rate_per_sec").MustFloat64(0)
+	if imageRatePerSec < 0 {
+		invalid("invalid image_rate_per_sec %v: must not be negative", imageRatePerSec)
+	}
+	imageRateBurst := cfg.Section("main").Key("image_rate_burst").MustInt(max(1, int(math.Ceil(imageRatePerSec))))
+	if imageRateBurst < 1 {
+		invalid("invalid image_rate_burst %d: must be at least 1", imageRateBurst)
+	}
+	trustedProxies := cfg.Section("main").Key("trusted_proxy").Strings(",")
+	for _, proxy := range trustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			invalid("invalid trusted_proxy %q: must be an IP or CIDR", proxy)
+		}
+	}
+	dbMaintenanceHours := cfg.Section("main").Key("db_maintenance_hours").MustInt(24)
+	if dbMaintenanceHours < 0 {
+		invalid("invalid db_maintenance_hours %d: must not be negative", dbMaintenanceHours)
+	}
+	logLevel := cfg.Section("main").Key("log_level").String()
+	if _, err := parseLogLevel(logLevel); logLevel != "" && err != nil {
+		invalid("invalid log_level %q: must be debug, info, warn or error", logLevel)
+	}
+	logFormat := cfg.Section("main").Key("log_format").MustString("text")
+	if logFormat != "text" && logFormat != "json" {
+		invalid("invalid log_format %q: must be text or json", logFormat)
+	}
+	watchMode := cfg.Section("main").Key("watch_mode").MustString("fsnotify")
+	if watchMode != "fsnotify" && watchMode != "poll" && watchMode != "auto" {
+		invalid("invalid watch_mode %q: must be fsnotify, poll or auto", watchMode)
+	}
+	pollIntervalSeconds := cfg.Section("main").Key("poll_interval_seconds").MustInt(60)
+	if pollIntervalSeconds < 1 {
+		invalid("invalid poll_interval_seconds %d: must be at least 1", pollIntervalSeconds)
+	}
+	// Originals may be served from another mount with the same layout
+	imageRoot := cfg.Section("main").Key("image_root").String()
+	if imageRoot == "" {
+		imageRoot = cfg.Section("main").Key("watched_folder").String()
+	}
+	config := Config{
 		WatchDir:                    cfg.Section("main").Key("watched_folder").String(),
-		ImageRoot:                   cfg.Section("main").Key("watched_folder").String(),
+		ImageRoot:                   imageRoot,
 		ImageCacheDir:               cfg.Section("main").Key("image_cache_folder").String(),
 		ImageCacheExpirationMinutes: cfg.Section("main").Key("image_cache_expiration_minutes").MustInt(60),
+		CacheCleanupIntervalMinutes: cacheCleanupIntervalMinutes,
 		HugoOutDir:                  cfg.Section("main").Key("hugo_built_out_folder").String(),
-		PhotoExts:                   cfg.Section("main").Key("photo_extensions").Strings(","),
-		VideoExts:                   cfg.Section("main").Key("video_extensions").Strings(","),
+		PhotoExts:                   normalizeExts(cfg.Section("main").Key("photo_extensions").Strings(",")),
+		VideoExts:                   normalizeExts(cfg.Section("main").Key("video_extensions").Strings(",")),
+		SniffContentType:            cfg.Section("main").Key("sniff_content_type").MustBool(false),
+		MediaSort:                   mediaSort,
+		MaxFilesPerPost:             maxFilesPerPost,
+		EnableAlbums:                cfg.Section("main").Key("enable_albums").MustBool(false),
 		ServerPort:                  cfg.Section("main").Key("http_port").MustString("8080"),
+		BindAddress:                 strings.Trim(cfg.Section("main").Key("bind_address").String(), "[]"),
 		SqlitePath:                  cfg.Section("main").Key("sqlite_db_path").String(),
 		HugoPath:                    cfg.Section("main").Key("hugo_bin_path").String(),
 		Archetype:                   cfg.Section("main").Key("hugo_archetype").String(),
+		CategoryArchetypes:          categoryArchetypes,
 		ContentDir:                  cfg.Section("main").Key("hugo_content_dir").MustString("content"),
+		PostLayout:                  postLayout,
 		Verbose:                     cfg.Section("main").Key("verbose").MustBool(false),
+		HugoPartialRebuild:          cfg.Section("main").Key("hugo_partial_rebuild").MustBool(false),
+		HugoConfig:                  cfg.Section("main").Key("hugo_config").String(),
+		HugoArgs:                    cfg.Section("main").Key("hugo_args").Strings(","),
+		HugoEnv:                     hugoEnv,
+		OutputFormat:                outputFormat,
+		JPEGQuality:                 jpegQuality,
+		StripMetadata:               cfg.Section("main").Key("strip_metadata").MustBool(false),
+		CorruptImagePlaceholder:     cfg.Section("main").Key("corrupt_image_placeholder").String(),
+		DateFromEXIF:                cfg.Section("main").Key("date_from_exif").MustBool(false),
+		FFmpegPath:                  cfg.Section("main").Key("ffmpeg_bin_path").MustString("ffmpeg"),
+		MaxCacheBytes:               cfg.Section("main").Key("max_cache_bytes").MustInt64(0),
+		ImageCacheSharding:          cfg.Section("main").Key("image_cache_sharding").MustBool(true),
+		ImageCacheKeySource:         cfg.Section("main").Key("image_cache_key_source").MustBool(true),
+		ImageOpenRetries:            imageOpenRetries,
+		AllowUpscale:                cfg.Section("main").Key("allow_upscale").MustBool(false),
+		PrecomputeWidths:            precomputeWidths,
+		AllowedWidths:               allowedWidths,
+		WarmCacheManifest:           cfg.Section("main").Key("warm_cache_manifest").String(),
+		ImageMaxConcurrent:          imageMaxConcurrent,
+		ResizeFilter:                resizeFilter,
+		IdleSecond:                  idleSecond,
+		RebuildMinInterval:          rebuildMinInterval,
+		IgnorePatterns:              ignorePatterns,
+		EnableGzip:                  cfg.Section("main").Key("enable_gzip").MustBool(true),
+		HTTPReadTimeoutSeconds:      httpReadTimeoutSeconds,
+		HTTPWriteTimeoutSeconds:     httpWriteTimeoutSeconds,
+		HTTPIdleTimeoutSeconds:      httpIdleTimeoutSeconds,
+		TLSCert:                     tlsCert,
+		TLSKey:                      tlsKey,
+		HTTPRedirectPort:            cfg.Section("main").Key("http_redirect_port").String(),
+		AuthUser:                    authUser,
+		AuthPass:                    authPass,
+		AuthPassBcrypt:              authPassBcrypt,
+		ImageRatePerSec:             imageRatePerSec,
+		ImageRateBurst:              imageRateBurst,
+		TrustedProxies:              trustedProxies,
+		NegotiateWebP:               cfg.Section("main").Key("negotiate_webp").MustBool(true),
+		ImageCacheControlSeconds:    imageCacheControlSeconds,
+		DBMaintenanceHours:          dbMaintenanceHours,
+		LogLevel:                    logLevel,
+		LogFormat:                   logFormat,
+		WatchMode:                   watchMode,
+		PollIntervalSeconds:         pollIntervalSeconds,
+		TagSkipWords:                tagSkipWords,
+		TagSkipWordsFile:            tagSkipWordsFile,
+		EnableJieba:                 cfg.Section("main").Key("enable_jieba").MustBool(true),
+		TagLanguage:                 tagLanguage,
+		MaxTags:                     maxTags,
+		JiebaUserWords:              jiebaUserWords,
+		JiebaUserDict:               cfg.Section("main").Key("jieba_user_dict").String(),
+		EnableMetrics:               cfg.Section("main").Key("enable_metrics").MustBool(false),
+		MetricsPort:                 cfg.Section("main").Key("metrics_port").String(),
+		FeedSize:                    feedSize,
+		FeedFormat:                  feedFormat,
+		FeedTitle:                   cfg.Section("main").Key("feed_title").MustString("New galleries"),
+	}
+	problems = append(problems, validatePaths(config)...)
+	return config, errors.Join(problems...)
+}
+
+// normalizeExts lowercases extensions and adds the leading dot, so "JPG",
+// "jpg" and ".jpg" all match what strings.ToLower(filepath.Ext(name)) gives.
+func normalizeExts(exts []string) []string {
+	normalized := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" || ext == "." {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+// validatePaths checks the files, folders and binaries the config points
+// at, so a typo is reported at startup rather than on first use.
+func validatePaths(config Config) []error {
+	var problems []error
+	invalid := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if config.WatchDir == "" {
+		invalid("watched_folder is not set")
+	} else if f, err := os.Open(config.WatchDir); err != nil {
+		invalid("watched_folder %q is not readable: %v", config.WatchDir, err)
+	} else {
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || !info.IsDir() {
+			invalid("watched_folder %q is not a folder", config.WatchDir)
+		}
+	}
+
+	if config.ImageRoot != config.WatchDir {
+		if info, err := os.Stat(config.ImageRoot); err != nil || !info.IsDir() {
+			invalid("image_root %q is not a readable folder", config.ImageRoot)
+		}
+	}
+
+	// Hugo creates the output folder on the first build, so only its parent
+	// has to exist
+	if config.HugoOutDir == "" {
+		invalid("hugo_built_out_folder is not set")
+	} else if info, err := os.Stat(config.HugoOutDir); err == nil {
+		if !info.IsDir() {
+			invalid("hugo_built_out_folder %q is not a folder", config.HugoOutDir)
+		}
+	} else if _, err := os.Stat(filepath.Dir(filepath.Clean(config.HugoOutDir))); err != nil {
+		invalid("hugo_built_out_folder %q cannot be created: %v", config.HugoOutDir, err)
+	}
+
+	if !checkHugoBinary {
+		// Not run in this mode
+	} else if config.HugoPath == "" {
+		invalid("hugo_bin_path is not set")
+	} else if _, err := exec.LookPath(config.HugoPath); err != nil {
+		invalid("hugo_bin_path %q not found: %v", config.HugoPath, err)
+	}
+
+	if config.Archetype == "" {
+		invalid("hugo_archetype is not set")
+	} else if f, err := os.Open(config.Archetype); err != nil {
+		invalid("hugo_archetype %q is not readable: %v", config.Archetype, err)
+	} else {
+		f.Close()
+	}
+	if config.CorruptImagePlaceholder != "" {
+		if f, err := os.Open(config.CorruptImagePlaceholder); err != nil {
+			invalid("corrupt_image_placeholder %q is not readable: %v", config.CorruptImagePlaceholder, err)
+		} else {
+			f.Close()
+		}
+	}
+	categories := make([]string, 0, len(config.CategoryArchetypes))
+	for category := range config.CategoryArchetypes {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		path := config.CategoryArchetypes[category]
+		if f, err := os.Open(path); err != nil {
+			invalid("category_archetypes %s %q is not readable: %v", category, path, err)
+		} else {
+			f.Close()
+		}
+	}
+
+	if config.SqlitePath == "" {
+		invalid("sqlite_db_path is not set")
+	}
+	if config.ImageCacheDir == "" {
+		invalid("image_cache_folder is not set")
+	}
+	if len(config.PhotoExts) == 0 {
+		invalid("photo_extensions is empty")
+	}
+	if len(config.VideoExts) == 0 {
+		invalid("video_extensions is empty")
+	}
+
+	ports := [][2]string{{"http_port", config.ServerPort}, {"http_redirect_port", config.HTTPRedirectPort}, {"metrics_port", config.MetricsPort}}
+	for _, port := range ports {
+		if port[1] == "" && port[0] != "http_port" {
+			continue
+		}
+		if n, err := strconv.Atoi(port[1]); err != nil || n < 1 || n > 65535 {
+			invalid("%s %q is not a port number", port[0], port[1])
+		}
+	}
+	if config.BindAddress != "" && net.ParseIP(config.BindAddress) == nil {
+		if _, err := net.LookupHost(config.BindAddress); err != nil {
+			invalid("bind_address %q is neither an IP address nor a resolvable host name: %v", config.BindAddress, err)
+		}
+	}
+
+	files := [][2]string{{"tls_cert", config.TLSCert}, {"tls_key", config.TLSKey}, {"jieba_user_dict", config.JiebaUserDict}, {"warm_cache_manifest", config.WarmCacheManifest}}
+	for _, file := range files {
+		if file[1] == "" {
+			continue
+		}
+		if f, err := os.Open(file[1]); err != nil {
+			invalid("%s %q is not readable: %v", file[0], file[1], err)
+		} else {
+			f.Close()
+		}
 	}
+	return problems
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeExts(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		{[]string{"jpg", ".JPG", "Jpeg", " png "}, []string{".jpg", ".jpg", ".jpeg", ".png"}},
+		{[]string{".mp4", "MOV"}, []string{".mp4", ".mov"}},
+		{[]string{"", ".", "  "}, []string{}},
+		{nil, []string{}},
+	}
+	for _, tt := range tests {
+		if got := normalizeExts(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeExts(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePathsHugoBinary(t *testing.T) {
+	g := newTestGallery(t)
+	config := g.config
+	config.HugoPath = "no-such-hugo-binary"
+	tests := []struct {
+		check bool
+		want  bool
+	}{
+		{true, true},
+		{false, false},
+	}
+	defer func(check bool) { checkHugoBinary = check }(checkHugoBinary)
+	for _, tt := range tests {
+		checkHugoBinary = tt.check
+		reported := false
+		for _, err := range validatePaths(config) {
+			if strings.Contains(err.Error(), "hugo_bin_path") {
+				reported = true
+			}
+		}
+		if reported != tt.want {
+			t.Errorf("checkHugoBinary %v: missing hugo binary reported = %v, want %v", tt.check, reported, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Bounds of the /contactsheet/ parameters. A sheet is at most
+// maxContactSheetSide pixels on either side, so a small w allows more rows.
+const (
+	defaultContactSheetCols = 5
+	maxContactSheetCols     = 10
+	defaultContactSheetCell = 200
+	minContactSheetCell     = 32
+	maxContactSheetCell     = 400
+	defaultContactSheetN    = 20
+	maxContactSheetN        = 100
+	maxContactSheetSide     = 4000
+)
+
+// Background of the cells left by photos that could not be decoded.
+var contactSheetBackground = color.NRGBA{R: 32, G: 32, B: 32, A: 255}
+
+// ContactSheet returns the path of a JPEG grid of the given photos of the
+// folder at relDir, cols per row, each cropped to a cell x cell square. The
+// sheet is named after the photo names, so it is regenerated when the folder
+// changes, and it is built under the same concurrency limit as resizes.
+func (ip *ImageProcessor) ContactSheet(ctx context.Context, relDir string, images []string, cols, cell int) (string, error) {
+	hash := cache_image_hash(filepath.Join(relDir, "contactsheet"), ImageOptions{Width: cell})
+	quality := currentConfig().JPEGQuality
+	name := fmt.Sprintf("%s_c%d_q%d_%s.jpg", hash, cols, quality, contentHash(images, nil, "")[:16])
+	cachedPath := cacheFile(ip.cacheDir, name)
+	return ip.generate(ctx, cachedPath, "", func() error {
+		return ip.drawContactSheet(filepath.Join(ip.resourceDir, relDir), images, cols, cell, quality, cachedPath)
+	})
+}
+
+func (ip *ImageProcessor) drawContactSheet(dir string, images []string, cols, cell, quality int, destPath string) error {
+	rows := (len(images) + cols - 1) / cols
+	sheet := imaging.New(min(cols, len(images))*cell, rows*cell, contactSheetBackground)
+	for i, name := range images {
+		src, err := imaging.Open(filepath.Join(dir, name), imaging.AutoOrientation(true))
+		if err != nil {
+			slog.Debug("Skipping photo in contact sheet", "path", filepath.Join(dir, name), "err", err)
+			continue
+		}
+		thumb := imaging.Fill(src, cell, cell, imaging.Center, ip.filter)
+		sheet = imaging.Paste(sheet, thumb, image.Pt(i%cols*cell, i/cols*cell))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := saveImage(sheet, destPath, "", quality); err != nil {
+		return fmt.Errorf("failed to save contact sheet: %w", err)
+	}
+	return nil
+}
+
+// handleContactSheet serves GET /contactsheet/{sha1}?cols=5&w=200&n=20, a
+// single JPEG combining the first n photos of a post in a grid of cols
+// columns of w x w cells.
+func handleContactSheet(config Config, db *sql.DB, ip *ImageProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderSHA := strings.TrimPrefix(r.URL.Path, "/contactsheet/")
+		if folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		cols, err := intParam(query.Get("cols"), defaultContactSheetCols, 1, maxContactSheetCols)
+		if err != nil {
+			http.Error(w, "Invalid cols parameter", http.StatusBadRequest)
+			return
+		}
+		cell, err := intParam(query.Get("w"), defaultContactSheetCell, minContactSheetCell, maxContactSheetCell)
+		if err != nil {
+			http.Error(w, "Invalid width parameter", http.StatusBadRequest)
+			return
+		}
+		n, err := intParam(query.Get("n"), defaultContactSheetN, 1, maxContactSheetN)
+		if err != nil {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+		cols = min(cols, maxContactSheetSide/cell)
+		n = min(n, cols*(maxContactSheetSide/cell))
+
+		relPath := GetRelPath(db, folderSHA)
+		folder, ok := safeJoin(config.ImageRoot, relPath)
+		if relPath == "" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		images, _ := classifyMedia(config, newIgnoreMatcher(config), filepath.Join(config.WatchDir, relPath), entries, nil, nil)
+		if len(images) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		images = images[:min(n, len(images))]
+
+		servedPath, err := ip.ContactSheet(r.Context(), relPath, images, cols, cell)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			if errors.Is(err, errTooManyResizes) {
+				w.Header().Set("Retry-After", "5")
+				http.Error(w, "Server busy, try again later", http.StatusAccepted)
+			} else {
+				http.Error(w, "Error generating contact sheet", http.StatusInternalServerError)
+			}
+			slog.Error("Contact sheet failed", "sha", folderSHA, "path", relPath, "err", err)
+			return
+		}
+
+		slog.Debug("Serving contact sheet", "sha", folderSHA, "path", servedPath, "photos", len(images), "cols", cols, "width", cell)
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeFile(w, r, servedPath)
+	}
+}
+
+// intParam parses an optional integer query parameter, returning def when it
+// is empty and an error when it is outside [lo, hi].
+func intParam(value string, def, lo, hi int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("must be an integer between %d and %d", lo, hi)
+	}
+	return n, nil
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"database/sql"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,61 +15,88 @@ import (
 
 var dbMutex sync.Mutex
 
+// Post is one row of the posts table.
+type Post struct {
+	FolderSHA   string
+	PostFile    string
+	Category    string   // folder categories joined by "/", in the category column
+	Tags        []string // the post's front matter tags, comma separated in tags and one per row in post_tags
+	RelPath     string   // folder path relative to the watched folder
+	NFile       int
+	Cover       string // first image of the folder, "" for video-only posts
+	ContentHash string // hash of the media file names, see contentHash
+	ParentSHA   string // folder SHA of the containing folder, "" directly in the watched folder
+	CreatedAt   time.Time
+}
+
 func InitDB(dbPath string) *sql.DB {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatalf("Error opening db: %v", err)
 	}
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS posts (
-		folder_sha TEXT PRIMARY KEY,
-		post_filename TEXT,
-		tags TEXT,
-		rel_path TEXT,
-		created_at TEXT,
-    n_file INTEGER
-	)`)
-	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+	if err := migrateDB(db); err != nil {
+		log.Fatalf("Error migrating db: %v", err)
 	}
 
+	initSearchIndex(db)
+
 	// Add WAL mode for better concurrency
 	_, err = db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
-		log.Printf("Warning: Could not enable WAL mode: %v", err)
+		slog.Warn("Could not enable WAL mode", "err", err)
 	}
 
 	// Set busy timeout
 	_, err = db.Exec("PRAGMA busy_timeout = 5000")
 	if err != nil {
-		log.Printf("Warning: Could not set busy timeout: %v", err)
+		slog.Warn("Could not set busy timeout", "err", err)
 	}
 
 	return db
 }
 
-func AddPost(db *sql.DB, folderSHA, postFile, tags, realPath string, nFile int) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+func AddPost(db *sql.DB, p Post) error {
+	defer observeQuery("add_post", time.Now())
+	return inTx(db, func(tx *sql.Tx) error { return insertPost(tx, p) })
+}
 
-	tx, err := db.Begin()
+func insertPost(tx *sql.Tx, p Post) error {
+	_, err := tx.Exec(
+		"INSERT OR REPLACE INTO posts (folder_sha, post_filename, category, tags, rel_path, created_at, n_file, cover, content_hash, parent_sha) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		p.FolderSHA, p.PostFile, p.Category, strings.Join(p.Tags, ","), p.RelPath, p.CreatedAt.Format(time.RFC3339), p.NFile, p.Cover, p.ContentHash, p.ParentSHA,
+	)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	if err := setPostTags(tx, p.FolderSHA, p.Tags); err != nil {
+		return err
+	}
+	return indexPost(tx, p)
+}
 
-	_, err = tx.Exec(
-		"INSERT OR REPLACE INTO posts (folder_sha, post_filename, tags, rel_path, created_at, n_file) VALUES (?, ?, ?, ?, ?, ?)",
-		folderSHA, postFile, tags, realPath, time.Now().Format(time.RFC3339), nFile,
-	)
+func RemovePost(db *sql.DB, folderSHA string) error {
+	defer observeQuery("remove_post", time.Now())
+	return inTx(db, func(tx *sql.Tx) error { return deletePost(tx, folderSHA) })
+}
+
+func deletePost(tx *sql.Tx, folderSHA string) error {
+	_, err := tx.Exec("DELETE FROM posts WHERE folder_sha = ?", folderSHA)
 	if err != nil {
 		return err
 	}
-
-	return tx.Commit()
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE folder_sha = ?", folderSHA); err != nil {
+		return err
+	}
+	if ftsEnabled {
+		if _, err := tx.Exec("DELETE FROM posts_fts WHERE folder_sha = ?", folderSHA); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func RemovePost(db *sql.DB, folderSHA string) error {
+// inTx runs fn in a transaction of its own under dbMutex.
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 
@@ -75,16 +105,14 @@ func RemovePost(db *sql.DB, folderSHA string) error {
 		return err
 	}
 	defer tx.Rollback()
-
-	_, err = tx.Exec("DELETE FROM posts WHERE folder_sha = ?", folderSHA)
-	if err != nil {
+	if err := fn(tx); err != nil {
 		return err
 	}
-
 	return tx.Commit()
 }
 
 func GetRelPath(db *sql.DB, folderSHA string) string {
+	defer observeQuery("get_rel_path", time.Now())
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 
@@ -94,44 +122,101 @@ func GetRelPath(db *sql.DB, folderSHA string) string {
 	return relPath
 }
 
-func UpdateNFile(db *sql.DB, folderSHA string, realPath string, nFile int) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+// UpdatePost refreshes the file count, date, tags and cover of an existing post.
+func UpdatePost(db *sql.DB, p Post) error {
+	defer observeQuery("update_post", time.Now())
+	return inTx(db, func(tx *sql.Tx) error { return updatePostRow(tx, p) })
+}
 
-	info, _ := os.Stat(realPath)
-	modTime := info.ModTime()
-	_, err = tx.Exec(`
+func updatePostRow(tx *sql.Tx, p Post) error {
+	_, err := tx.Exec(`
 		UPDATE posts
 		SET n_file = ?,
-			created_at = ?
+			created_at = ?,
+			category = ?,
+			tags = ?,
+			cover = ?,
+			content_hash = ?,
+			parent_sha = ?
 		WHERE folder_sha = ?`,
-		nFile, modTime.Format(time.RFC3339), folderSHA)
+		p.NFile, p.CreatedAt.Format(time.RFC3339), p.Category, strings.Join(p.Tags, ","), p.Cover, p.ContentHash, p.ParentSHA, p.FolderSHA)
 	if err != nil {
 		return err
 	}
+	if err := setPostTags(tx, p.FolderSHA, p.Tags); err != nil {
+		return err
+	}
+	if ftsEnabled {
+		_, err = tx.Exec("UPDATE posts_fts SET category = ?, tags = ? WHERE folder_sha = ?",
+			p.Category, strings.Join(p.Tags, " "), p.FolderSHA)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPostTags replaces the post_tags rows of a post with tags.
+func setPostTags(tx *sql.Tx, folderSHA string, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE folder_sha = ?", folderSHA); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO post_tags (folder_sha, tag) VALUES (?, ?)", folderSHA, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return tx.Commit()
+// TagCount is a tag with the number of posts that have it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// TagCounts returns every tag with its number of posts, most used first.
+func TagCounts(db *sql.DB) ([]TagCount, error) {
+	defer observeQuery("tag_counts", time.Now())
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	rows, err := db.Query("SELECT tag, COUNT(*) FROM post_tags GROUP BY tag ORDER BY COUNT(*) DESC, tag")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
 }
 
-func GetNFile(db *sql.DB, folderSHA string) int {
-	var nFile int
-	row := db.QueryRow("SELECT n_file FROM posts WHERE folder_sha = ?", folderSHA)
-	row.Scan(&nFile)
-	return nFile
+// GetContentHash returns the stored content hash of a post, "" if unknown.
+func GetContentHash(db *sql.DB, folderSHA string) string {
+	defer observeQuery("get_content_hash", time.Now())
+	var hash sql.NullString
+	row := db.QueryRow("SELECT content_hash FROM posts WHERE folder_sha = ?", folderSHA)
+	row.Scan(&hash)
+	return hash.String
 }
 
 // Load all mappings from SQLite
 func LoadFolderMap(db *sql.DB) map[string]string {
+	defer observeQuery("load_folder_map", time.Now())
 	fmap := make(map[string]string)
 	rows, err := db.Query("SELECT folder_sha, rel_path FROM posts")
 	if err != nil {
-		log.Println("Error loading folder map:", err)
+		slog.Error("Loading folder map failed", "err", err)
 		return fmap
 	}
 	defer rows.Close()
@@ -143,3 +228,275 @@ func LoadFolderMap(db *sql.DB) map[string]string {
 	}
 	return fmap
 }
+
+// CountPosts returns the number of posts.
+func CountPosts(db *sql.DB) (int, error) {
+	defer observeQuery("count_posts", time.Now())
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&n)
+	return n, err
+}
+
+// CountMediaFiles returns the number of photos and videos of all posts.
+func CountMediaFiles(db *sql.DB) (int, error) {
+	defer observeQuery("count_media_files", time.Now())
+	var n int
+	err := db.QueryRow("SELECT COALESCE(SUM(n_file), 0) FROM posts WHERE n_file > 0").Scan(&n)
+	return n, err
+}
+
+// ListPosts returns one page of posts ordered by created_at, newest first
+// unless ascending is set, together with the total number of posts.
+func ListPosts(db *sql.DB, offset, limit int, ascending bool) ([]Post, int, error) {
+	defer observeQuery("list_posts", time.Now())
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order := "DESC"
+	if ascending {
+		order = "ASC"
+	}
+	rows, err := db.Query(`
+		SELECT `+postColumns+`
+		FROM posts
+		ORDER BY created_at `+order+`, folder_sha
+		LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	posts := make([]Post, 0, limit)
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, total, rows.Err()
+}
+
+// GetPost returns the post of folderSHA, or sql.ErrNoRows when it is unknown.
+func GetPost(db *sql.DB, folderSHA string) (Post, error) {
+	defer observeQuery("get_post", time.Now())
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	return scanPost(db.QueryRow("SELECT "+postColumns+" FROM posts WHERE folder_sha = ?", folderSHA))
+}
+
+// postColumns are the columns scanPost reads, in its order.
+const postColumns = "folder_sha, post_filename, COALESCE(category, ''), COALESCE(tags, ''), rel_path, created_at, n_file, COALESCE(cover, ''), COALESCE(parent_sha, '')"
+
+// scanPost reads a row selected with postColumns.
+func scanPost(row interface{ Scan(...any) error }) (Post, error) {
+	var p Post
+	var tags, createdAt string
+	if err := row.Scan(&p.FolderSHA, &p.PostFile, &p.Category, &tags, &p.RelPath, &createdAt, &p.NFile, &p.Cover, &p.ParentSHA); err != nil {
+		return p, err
+	}
+	if tags != "" {
+		p.Tags = strings.Split(tags, ",")
+	}
+	p.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return p, nil
+}
+
+// PostSiblings returns the posts before and after folderSHA, ordered by
+// created_at or, with byPath, by rel_path; ties are broken by folder_sha.
+// A missing neighbor is nil, and sql.ErrNoRows means folderSHA is unknown.
+func PostSiblings(db *sql.DB, folderSHA string, byPath bool) (prev, next *Post, err error) {
+	defer observeQuery("post_siblings", time.Now())
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	key := "created_at"
+	if byPath {
+		key = "rel_path"
+	}
+	var value string
+	if err := db.QueryRow("SELECT "+key+" FROM posts WHERE folder_sha = ?", folderSHA).Scan(&value); err != nil {
+		return nil, nil, err
+	}
+
+	neighbor := func(cmp, order string) (*Post, error) {
+		p, err := scanPost(db.QueryRow(`
+			SELECT `+postColumns+`
+			FROM posts
+			WHERE `+key+` `+cmp+` ? OR (`+key+` = ? AND folder_sha `+cmp+` ?)
+			ORDER BY `+key+` `+order+`, folder_sha `+order+`
+			LIMIT 1`, value, value, folderSHA))
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return &p, err
+	}
+	if prev, err = neighbor("<", "DESC"); err != nil {
+		return nil, nil, err
+	}
+	if next, err = neighbor(">", "ASC"); err != nil {
+		return nil, nil, err
+	}
+	return prev, next, nil
+}
+
+// RandomPosts returns up to limit random non-empty posts, with only their
+// SHA and relative path set. A category limits them to that category and the
+// ones below it.
+func RandomPosts(db *sql.DB, category string, limit int) ([]Post, error) {
+	defer observeQuery("random_posts", time.Now())
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	query := "SELECT folder_sha, rel_path FROM posts WHERE n_file > 0"
+	var args []any
+	if category != "" {
+		query += ` AND (category = ? OR category LIKE ? ESCAPE '\')`
+		args = append(args, category, strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(category)+"/%")
+	}
+	rows, err := db.Query(query+" ORDER BY RANDOM() LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.FolderSHA, &p.RelPath); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// ftsEnabled is set when SQLite has FTS5 and posts_fts exists. The default
+// go-sqlite3 build lacks FTS5; build with -tags sqlite_fts5 to enable it.
+var ftsEnabled bool
+
+// initSearchIndex enables the posts_fts full-text index that migration 6
+// creates, if this build's SQLite can read it.
+func initSearchIndex(db *sql.DB) {
+	if _, err := db.Exec("SELECT folder_sha FROM posts_fts LIMIT 0"); err != nil {
+		slog.Warn("Full-text search unavailable, using LIKE queries (build with -tags sqlite_fts5)", "err", err)
+		return
+	}
+	ftsEnabled = true
+}
+
+// indexPost replaces the search index entry of p.
+func indexPost(tx *sql.Tx, p Post) error {
+	if !ftsEnabled {
+		return nil
+	}
+	return replaceSearchEntry(tx, p)
+}
+
+func replaceSearchEntry(tx *sql.Tx, p Post) error {
+	if _, err := tx.Exec("DELETE FROM posts_fts WHERE folder_sha = ?", p.FolderSHA); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO posts_fts (folder_sha, name, category, tags) VALUES (?, ?, ?, ?)",
+		p.FolderSHA, filepath.Base(p.RelPath), p.Category, strings.Join(p.Tags, " "))
+	return err
+}
+
+// SearchPosts returns the SHAs of posts whose name, category or tags contain
+// every word of query, best matches first. Words match as prefixes with
+// FTS5, and as substrings in the LIKE fallback.
+func SearchPosts(db *sql.DB, query string) ([]string, error) {
+	defer observeQuery("search_posts", time.Now())
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	var rows *sql.Rows
+	var err error
+	if ftsEnabled {
+		match := make([]string, len(terms))
+		for i, term := range terms {
+			match[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+		}
+		rows, err = db.Query("SELECT folder_sha FROM posts_fts WHERE posts_fts MATCH ? ORDER BY rank",
+			strings.Join(match, " "))
+	} else {
+		var where []string
+		var args []any
+		for _, term := range terms {
+			like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+			where = append(where, `(rel_path LIKE ? ESCAPE '\' OR category LIKE ? ESCAPE '\' OR tags LIKE ? ESCAPE '\')`)
+			args = append(args, like, like, like)
+		}
+		rows, err = db.Query("SELECT folder_sha FROM posts WHERE "+strings.Join(where, " AND ")+" ORDER BY created_at DESC", args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shas []string
+	for rows.Next() {
+		var sha string
+		if err := rows.Scan(&sha); err != nil {
+			return nil, err
+		}
+		shas = append(shas, sha)
+	}
+	return shas, rows.Err()
+}
+
+// checkAndVacuum runs PRAGMA integrity_check and then VACUUM to return the
+// space left by deleted and replaced rows to the file system.
+func checkAndVacuum(db *sql.DB, dbPath string) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		slog.Error("Database integrity check failed", "err", err)
+		return
+	}
+	if result != "ok" {
+		slog.Error("Database integrity check reported problems", "result", result)
+		return
+	}
+
+	before := fileSize(dbPath)
+	start := time.Now()
+	if _, err := db.Exec("VACUUM"); err != nil {
+		slog.Error("Database vacuum failed", "err", err)
+		return
+	}
+	slog.Info("Database integrity ok, vacuumed", "before", before, "after", fileSize(dbPath), "took", time.Since(start))
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func startDBMaintenance(config Config, db *sql.DB) {
+	if config.DBMaintenanceHours <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(config.DBMaintenanceHours) * time.Hour)
+	go func() {
+		for range ticker.C {
+			slog.Info("Starting database maintenance")
+			checkAndVacuum(db, config.SqlitePath)
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// handleDownload serves GET /download/{sha1}.zip, streaming every photo and
+// video of the folder into an uncompressed ZIP archive.
+func handleDownload(config Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderSHA, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/download/"), ".zip")
+		if !ok || folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		relPath := GetRelPath(db, folderSHA)
+		folder, ok := safeJoin(config.ImageRoot, relPath)
+		if relPath == "" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// Ignore rules live in the watched copy of the folder
+		images, videos := classifyMedia(config, newIgnoreMatcher(config), filepath.Join(config.WatchDir, relPath), entries, nil, nil)
+		files := append(images, videos...)
+		if len(files) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		name := filepath.Base(relPath) + ".zip"
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		slog.Debug("Streaming folder download", "sha", folderSHA, "path", folder, "files", len(files), "name", name)
+
+		clearWriteDeadline(w)
+		zw := zip.NewWriter(w)
+		for _, file := range files {
+			if err := addZipFile(zw, folder, file); err != nil {
+				// Headers are already sent; abort so the client sees a broken archive
+				slog.Error("Writing file to ZIP failed", "sha", folderSHA, "file", file, "err", err)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			slog.Error("Finishing ZIP failed", "sha", folderSHA, "path", folder, "err", err)
+		}
+	}
+}
+
+// addZipFile copies one file into the archive with the Store method, since
+// photos and videos are already compressed.
+func addZipFile(zw *zip.Writer, folder, name string) error {
+	path, ok := safeJoin(folder, filepath.Base(name))
+	if !ok {
+		return os.ErrNotExist
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(name)
+	header.Method = zip.Store
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// safeJoin joins rel to root and reports whether the result stays inside root.
+func safeJoin(root, rel string) (string, bool) {
+	path := filepath.Join(root, rel)
+	within, err := filepath.Rel(root, path)
+	if err != nil || within == ".." || strings.HasPrefix(within, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	root := filepath.FromSlash("/srv/photos")
+	tests := []struct {
+		rel    string
+		want   string
+		wantOK bool
+	}{
+		{"Album/a.jpg", "/srv/photos/Album/a.jpg", true},
+		{"Album/../Other/a.jpg", "/srv/photos/Other/a.jpg", true},
+		{"..", "", false},
+		{"../etc/passwd", "", false},
+		{"Album/../../etc/passwd", "", false},
+		{"../photos2/a.jpg", "", false},
+		// Absolute paths are joined below root, never taken as they are
+		{"/etc/passwd", "/srv/photos/etc/passwd", true},
+		// safeJoin does not decode: these are odd but harmless file names
+		{"..%2Fetc%2Fpasswd", "/srv/photos/..%2Fetc%2Fpasswd", true},
+		{"%2E%2E/a.jpg", "/srv/photos/%2E%2E/a.jpg", true},
+		{"...", "/srv/photos/...", true},
+	}
+	for _, tt := range tests {
+		got, ok := safeJoin(root, tt.rel)
+		if ok != tt.wantOK || got != filepath.FromSlash(tt.want) {
+			t.Errorf("safeJoin(%q) = %q, %v, want %q, %v", tt.rel, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestMediaRelPathRejectsEncodedTraversal(t *testing.T) {
+	g := newTestGallery(t)
+	sha := g.addFolder(t, "Album", nil)
+	for _, file := range []string{
+		"..%2F..%2Fetc%2Fpasswd",
+		"%2E%2E%2Fa.jpg",
+		"%2e%2e%5ca.jpg",
+		"..%5C..%5Cwin.ini",
+		"%2Fetc%2Fpasswd",
+		"a.jpg%2F..%2F..%2Fx",
+	} {
+		if rel, ok := mediaRelPath(g.db, sha, file); ok {
+			t.Errorf("mediaRelPath(%q) = %q, want rejected", file, rel)
+		}
+	}
+	if rel, ok := mediaRelPath(g.db, sha, "a%20b.jpg"); !ok || rel != filepath.Join("Album", "a b.jpg") {
+		t.Errorf("mediaRelPath(%q) = %q, %v, want %q", "a%20b.jpg", rel, ok, filepath.Join("Album", "a b.jpg"))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DryRunScan walks WatchDir like InitScanFolders and logs the post each
+// folder would get, with its category and tags, without writing markdown,
+// touching the database or building Hugo. An existing database is opened
+// read-only to tell new folders from changed and unchanged ones.
+func DryRunScan(config Config) {
+	var db *sql.DB
+	if _, err := os.Stat(config.SqlitePath); err == nil {
+		db, err = sql.Open("sqlite3", "file:"+config.SqlitePath+"?mode=ro")
+		if err != nil {
+			slog.Error("Opening database read-only failed, treating every folder as new", "err", err)
+			db = nil
+		} else {
+			defer db.Close()
+		}
+	}
+
+	var created, updated, unchanged, removed, empty int
+	seen := make(map[string]bool)
+	ignore := newIgnoreMatcher(config)
+	err := filepath.WalkDir(config.WatchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == config.WatchDir {
+			return nil
+		}
+		if ignore.ignored(path, true) {
+			slog.Info("Dry run: would skip ignored folder", "path", path)
+			return filepath.SkipDir
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			slog.Error("Reading folder failed", "path", path, "err", err)
+			return nil
+		}
+		images, videos := classifyMedia(config, ignore, path, entries, nil, nil)
+		totalFiles := len(images) + len(videos)
+		folderSHA := sha1Hex(path)
+		seen[folderSHA] = true
+		existingPath := ""
+		if db != nil {
+			existingPath = GetRelPath(db, folderSHA)
+		}
+
+		action := "create"
+		var children []AlbumChild
+		if totalFiles == 0 {
+			children = albumChildren(config, path, entries)
+		}
+		switch {
+		case len(children) > 0 && existingPath != "" && GetContentHash(db, folderSHA) == albumHash(children, readDescription(path)):
+			unchanged++
+			slog.Debug("Dry run: unchanged, would skip", "sha", folderSHA, "path", path)
+			return nil
+		case len(children) > 0:
+			if existingPath == "" {
+				created++
+			} else {
+				action = "update"
+				updated++
+			}
+			slog.Info("Dry run: would "+action+" album", "sha", folderSHA, "path", path, "children", len(children))
+			return nil
+		case totalFiles == 0 && existingPath == "":
+			empty++
+			slog.Debug("Dry run: no media files, would skip", "path", path)
+			return nil
+		case totalFiles == 0:
+			removed++
+			slog.Info("Dry run: no media files left, would remove post", "sha", folderSHA, "path", path)
+			return nil
+		case existingPath == "":
+			created++
+		case GetContentHash(db, folderSHA) == contentHash(images, videos, readDescription(path)):
+			unchanged++
+			slog.Debug("Dry run: unchanged, would skip", "sha", folderSHA, "path", path)
+			return nil
+		default:
+			action = "update"
+			updated++
+		}
+
+		rel_path, _ := filepath.Rel(config.WatchDir, path)
+		categories := getCategories(rel_path)
+		slog.Info("Dry run: would "+action+" post", "sha", folderSHA, "path", path, "files", totalFiles,
+			"category", strings.Join(categories, "/"), "tags", getTags(categories, filepath.Base(path)),
+			"cover", coverImage(images))
+		return nil
+	})
+	if err != nil {
+		slog.Error("Folder scan failed", "err", err)
+	}
+
+	// Posts whose folder is gone or now ignored would be removed by housekeeping
+	if db != nil {
+		for folderSHA, relPath := range LoadFolderMap(db) {
+			if !seen[folderSHA] {
+				removed++
+				slog.Info("Dry run: folder gone, would remove post", "sha", folderSHA, "path", filepath.Join(config.WatchDir, relPath))
+			}
+		}
+	}
+	slog.Info("Dry run finished, nothing was written", "create", created, "update", updated,
+		"unchanged", unchanged, "remove", removed, "empty", empty)
+}
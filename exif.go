@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifDateEntry is a decoded capture date, valid while the file's mtime is
+// unchanged.
+type exifDateEntry struct {
+	modTime time.Time
+	date    time.Time
+	ok      bool
+}
+
+var (
+	exifDates   = make(map[string]exifDateEntry) // by image path
+	exifDateMux sync.Mutex
+)
+
+// postDate returns the date of a folder's post: with date_from_exif, the
+// earliest EXIF capture date of its images, else the folder's mtime.
+func postDate(config Config, path string, images []string) time.Time {
+	if config.DateFromEXIF {
+		if date, ok := captureDate(path, images); ok {
+			return date
+		}
+	}
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Now()
+}
+
+// captureDate returns the earliest EXIF DateTimeOriginal among images.
+func captureDate(dir string, images []string) (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for _, name := range images {
+		if date, ok := exifDate(filepath.Join(dir, name)); ok && (!found || date.Before(earliest)) {
+			earliest, found = date, true
+		}
+	}
+	return earliest, found
+}
+
+// exifDate reads the capture date of one image, decoding it only once per
+// file version.
+func exifDate(path string) (time.Time, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	exifDateMux.Lock()
+	entry, cached := exifDates[path]
+	exifDateMux.Unlock()
+	if cached && entry.modTime.Equal(info.ModTime()) {
+		return entry.date, entry.ok
+	}
+
+	entry = exifDateEntry{modTime: info.ModTime()}
+	if f, err := os.Open(path); err == nil {
+		if x, err := exif.Decode(f); err == nil {
+			// DateTime prefers DateTimeOriginal over the modification tag
+			entry.date, err = x.DateTime()
+			entry.ok = err == nil && !entry.date.IsZero()
+		}
+		f.Close()
+	}
+	exifDateMux.Lock()
+	exifDates[path] = entry
+	exifDateMux.Unlock()
+	return entry.date, entry.ok
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Width of the cover thumbnails linked from feed entries.
+const feedThumbWidth = 600
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string        `xml:"title"`
+	Link      string        `xml:"link"`
+	GUID      string        `xml:"guid"`
+	PubDate   string        `xml:"pubDate"`
+	Category  string        `xml:"category,omitempty"`
+	Enclosure *rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int    `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title    string        `xml:"title"`
+	ID       string        `xml:"id"`
+	Updated  string        `xml:"updated"`
+	Links    []atomLink    `xml:"link"`
+	Category *atomCategory `xml:"category"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// handleFeed serves GET /feed.xml: the newest feed_size posts as an RSS or
+// Atom feed, by feed_format, linking each Hugo page and its cover thumbnail.
+// It reads only the database. Links are made absolute with the request's host.
+func handleFeed(config Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		posts, _, err := ListPosts(db, 0, config.FeedSize, false)
+		if err != nil {
+			slog.Error("Listing posts for the feed failed", "err", err)
+			http.Error(w, "Error listing posts", http.StatusInternalServerError)
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base := scheme + "://" + r.Host
+		thumbType := imageContentType(outputFormats[config.OutputFormat])
+
+		var feed any
+		contentType := "application/rss+xml"
+		if config.FeedFormat == "atom" {
+			contentType = "application/atom+xml"
+			atom := atomFeed{
+				Title: config.FeedTitle,
+				ID:    base + "/",
+				Links: []atomLink{{Href: base + "/feed.xml", Rel: "self"}, {Href: base + "/"}},
+			}
+			for _, p := range posts {
+				post := newAPIPost(p)
+				entry := atomEntry{
+					Title:   post.Name,
+					ID:      base + post.URL,
+					Updated: p.CreatedAt.Format(time.RFC3339),
+					Links:   []atomLink{{Href: base + post.URL, Rel: "alternate"}},
+				}
+				if post.Category != "" {
+					entry.Category = &atomCategory{Term: post.Category}
+				}
+				if post.CoverURL != "" {
+					entry.Links = append(entry.Links, atomLink{
+						Href: base + post.CoverURL + "?w=" + strconv.Itoa(feedThumbWidth),
+						Rel:  "enclosure",
+						Type: coverType(thumbType, p.Cover),
+					})
+				}
+				atom.Entries = append(atom.Entries, entry)
+			}
+			atom.Updated = time.Now().Format(time.RFC3339)
+			if len(posts) > 0 {
+				atom.Updated = posts[0].CreatedAt.Format(time.RFC3339)
+			}
+			feed = atom
+		} else {
+			rss := rssFeed{Version: "2.0", Channel: rssChannel{
+				Title:       config.FeedTitle,
+				Link:        base + "/",
+				Description: config.FeedTitle,
+			}}
+			if len(posts) > 0 {
+				rss.Channel.LastBuildDate = posts[0].CreatedAt.Format(time.RFC1123Z)
+			}
+			for _, p := range posts {
+				post := newAPIPost(p)
+				item := rssItem{
+					Title:    post.Name,
+					Link:     base + post.URL,
+					GUID:     base + post.URL,
+					PubDate:  p.CreatedAt.Format(time.RFC1123Z),
+					Category: post.Category,
+				}
+				if post.CoverURL != "" {
+					item.Enclosure = &rssEnclosure{
+						URL:  base + post.CoverURL + "?w=" + strconv.Itoa(feedThumbWidth),
+						Type: coverType(thumbType, p.Cover),
+					}
+				}
+				rss.Channel.Items = append(rss.Channel.Items, item)
+			}
+			feed = rss
+		}
+
+		w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(feed); err != nil {
+			slog.Error("Writing feed failed", "err", err)
+		}
+	}
+}
+
+// coverType is the content type of a cover thumbnail: that of output_format
+// when one is set, else the cover's own.
+func coverType(thumbType, cover string) string {
+	if thumbType != "" {
+		return thumbType
+	}
+	return imageContentType(cover)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// galleryPasswordFile is the sidecar holding the passphrase of a protected
+// folder, in plain text or as a bcrypt hash.
+const galleryPasswordFile = ".password"
+
+// How long a gallery login lasts.
+const gallerySessionTTL = 7 * 24 * time.Hour
+
+// gallerySecret signs gallery session cookies. It is drawn at startup, so a
+// restart logs every visitor out.
+var gallerySecret = func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}()
+
+// galleryPassword returns the passphrase protecting the folder at relPath,
+// "" when it is public.
+func galleryPassword(config Config, relPath string) string {
+	data, err := os.ReadFile(filepath.Join(config.WatchDir, relPath, galleryPasswordFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// checkGalleryPassword compares pass with a gallery's passphrase in constant
+// time, or against its bcrypt hash.
+func checkGalleryPassword(want, pass string) bool {
+	if strings.HasPrefix(want, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) == nil
+	}
+	passHash := sha256.Sum256([]byte(pass))
+	wantHash := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(passHash[:], wantHash[:]) == 1
+}
+
+// galleryToken signs a login to folderSHA valid until expires. The
+// passphrase is part of the signature, so changing it ends every login.
+func galleryToken(folderSHA, password string, expires int64) string {
+	mac := hmac.New(sha256.New, gallerySecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", folderSHA, password, expires)
+	return strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func galleryCookieName(folderSHA string) string {
+	return "gallery_" + folderSHA
+}
+
+// galleryAuthorized reports whether r carries an unexpired login to folderSHA.
+func galleryAuthorized(r *http.Request, folderSHA, password string) bool {
+	cookie, err := r.Cookie(galleryCookieName(folderSHA))
+	if err != nil {
+		return false
+	}
+	expiresStr, _, _ := strings.Cut(cookie.Value, ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(galleryToken(folderSHA, password, expires)))
+}
+
+// withGalleryPassword answers 401 for the media of a folder with a .password
+// sidecar unless the request carries a login to it; prefix is the endpoint
+// path the folder SHA follows. Responses for protected folders are marked
+// private, so shared caches don't keep them.
+func withGalleryPassword(config Config, db *sql.DB, prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folderSHA, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		folderSHA = strings.TrimSuffix(folderSHA, ".zip")
+		relPath := GetRelPath(db, folderSHA)
+		password := ""
+		if relPath != "" {
+			password = galleryPassword(config, relPath)
+		}
+		if password == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !galleryAuthorized(r, folderSHA, password) {
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "This gallery is password protected, log in at /login/"+folderSHA, http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(&privateWriter{ResponseWriter: w}, r)
+	})
+}
+
+// privateWriter turns a public Cache-Control header into a private one.
+type privateWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (pw *privateWriter) WriteHeader(status int) {
+	if !pw.wroteHeader {
+		pw.wroteHeader = true
+		header := pw.Header()
+		if cc := header.Get("Cache-Control"); strings.Contains(cc, "public") {
+			header.Set("Cache-Control", strings.Replace(cc, "public", "private", 1))
+		}
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *privateWriter) Write(b []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *privateWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width">
+<title>{{ .Name }}</title></head>
+<body>
+<form method="post">
+<p>{{ .Name }} is password protected.</p>
+{{ with .Error }}<p>{{ . }}</p>{{ end }}
+<input type="hidden" name="next" value="{{ .Next }}">
+<input type="password" name="password" autofocus required>
+<button type="submit">View</button>
+</form>
+</body></html>
+`))
+
+type loginData struct {
+	Name  string
+	Next  string
+	Error string
+}
+
+// handleGalleryLogin serves /login/{sha1}: GET shows a passphrase form, and
+// POST checks the password field, sets the gallery's session cookie and
+// redirects to next, a local path, or else to the post.
+func handleGalleryLogin(config Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		folderSHA := strings.TrimPrefix(r.URL.Path, "/login/")
+		if folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		relPath := GetRelPath(db, folderSHA)
+		password := ""
+		if relPath != "" {
+			password = galleryPassword(config, relPath)
+		}
+		if password == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		next := r.FormValue("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+			next = postURL(config, relPath, folderSHA)
+		}
+		data := loginData{Name: filepath.Base(relPath), Next: next}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			if checkGalleryPassword(password, r.PostFormValue("password")) {
+				expires := time.Now().Add(gallerySessionTTL)
+				http.SetCookie(w, &http.Cookie{
+					Name:     galleryCookieName(folderSHA),
+					Value:    galleryToken(folderSHA, password, expires.Unix()),
+					Path:     "/",
+					Expires:  expires,
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+				slog.Info("Gallery login", "sha", folderSHA, "remote", r.RemoteAddr)
+				http.Redirect(w, r, next, http.StatusSeeOther)
+				return
+			}
+			slog.Warn("Failed gallery login", "sha", folderSHA, "remote", r.RemoteAddr)
+			data.Error = "Wrong password."
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		loginPage.Execute(w, data)
+	}
+}
@@ -5,16 +5,27 @@ go 1.24.0
 toolchain go1.24.7
 
 require (
+	github.com/buckket/go-blurhash v1.1.0
+	github.com/chai2010/webp v1.4.0
 	github.com/deckarep/golang-set/v2 v2.8.0
 	github.com/disintegration/imaging v1.6.2
 	github.com/fsnotify/fsnotify v1.9.0
+	github.com/gen2brain/avif v0.4.4
+	github.com/ikawaha/kagome-dict/ipa v1.2.6
+	github.com/ikawaha/kagome/v2 v2.11.0
 	github.com/mattn/go-sqlite3 v1.14.31
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/yanyiwu/gojieba v1.4.6
+	golang.org/x/crypto v0.36.0
+	golang.org/x/time v0.11.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
+	github.com/ebitengine/purego v0.8.3 // indirect
+	github.com/ikawaha/kagome-dict v1.1.7 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
+	github.com/tetratelabs/wazero v1.9.0 // indirect
 	golang.org/x/image v0.30.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
 )
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testGallery is a watched folder with its database and image processor.
+type testGallery struct {
+	config Config
+	db     *sql.DB
+	ip     *ImageProcessor
+}
+
+// newTestGallery returns an empty gallery in a temporary folder, with the
+// config defaults the handlers rely on. It is also made the live config.
+func newTestGallery(t testing.TB) *testGallery {
+	t.Helper()
+	dir := t.TempDir()
+	watchDir := filepath.Join(dir, "photos")
+	if err := os.MkdirAll(watchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		WatchDir:                    watchDir,
+		ImageRoot:                   watchDir,
+		ImageCacheDir:               filepath.Join(dir, "cache"),
+		ImageCacheExpirationMinutes: 60,
+		HugoOutDir:                  filepath.Join(dir, "public"),
+		ContentDir:                  filepath.Join(dir, "content"),
+		Archetype:                   "archetypes/photo.md",
+		PhotoExts:                   []string{".jpg", ".jpeg", ".png"},
+		VideoExts:                   []string{".mp4"},
+		MediaSort:                   "name_natural",
+		PostLayout:                  postLayoutFlat,
+		JPEGQuality:                 85,
+		ImageMaxConcurrent:          4,
+		ResizeFilter:                "lanczos",
+		TagLanguage:                 "en",
+		ImageCacheControlSeconds:    3600,
+	}
+	setLiveConfig(t, config)
+	tmpl, err := loadTemplate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveTemplate.Store(tmpl)
+
+	db := InitDB(filepath.Join(dir, "posts.db"))
+	t.Cleanup(func() { db.Close() })
+	return &testGallery{config: config, db: db, ip: NewImageProcessor(config)}
+}
+
+// setLiveConfig makes config the live one for the rest of the test.
+func setLiveConfig(t testing.TB, config Config) {
+	t.Helper()
+	old := liveConfig.Load()
+	liveConfig.Store(&config)
+	t.Cleanup(func() { liveConfig.Store(old) })
+}
+
+// addFolder creates the folder relPath with files and records its post,
+// returning the folder SHA.
+func (g *testGallery) addFolder(t testing.TB, relPath string, files map[string][]byte) string {
+	t.Helper()
+	dir := filepath.Join(g.config.WatchDir, relPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folderSHA := sha1Hex(dir)
+	err := AddPost(g.db, Post{
+		FolderSHA: folderSHA,
+		PostFile:  folderSHA + ".md",
+		RelPath:   relPath,
+		NFile:     len(files),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return folderSHA
+}
+
+// testJPEG returns a width x height JPEG filled with c.
+func testJPEG(t testing.TB, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the Hugo segment used for partial renders.
+const hugoSegmentName = "hugo_gallery_partial"
+
+var (
+	mu            sync.Mutex // protects pending, buildTimer and lastFullBuild
+	pending       = pendingBuild{pages: make(map[string]struct{})}
+	buildTimer    *time.Timer // fires once the idle window passes without new requests
+	lastFullBuild time.Time   // end of the last full build
+	buildMux      sync.Mutex  // serializes Hugo runs
+)
+
+// pendingBuild accumulates the work requested since the last Hugo run, so
+// a burst of changes is coalesced into one build.
+type pendingBuild struct {
+	full  bool                // a full site build was requested
+	lists bool                // list/taxonomy pages must be re-rendered
+	pages map[string]struct{} // Hugo page paths (e.g. /post/<sha>) to render
+}
+
+func (b pendingBuild) empty() bool {
+	return !b.full && !b.lists && len(b.pages) == 0
+}
+
+// rebuildHugo requests a full build of the Hugo site once no other build
+// request arrived for idle_second seconds.
+func rebuildHugo(config Config) {
+	mu.Lock()
+	pending.full = true
+	mu.Unlock()
+	scheduleBuild(config)
+}
+
+// rebuildHugoNow runs a full build immediately and waits for it.
+func rebuildHugoNow(config Config) {
+	mu.Lock()
+	pending.full = true
+	mu.Unlock()
+	runPendingBuild(config)
+}
+
+// rebuildHugoPage requests a render of a single post page. When lists is true
+// the home, section and taxonomy pages are rendered as well. Falls back to a
+// full build unless hugo_partial_rebuild is enabled.
+func rebuildHugoPage(config Config, page string, lists bool) {
+	if !config.HugoPartialRebuild {
+		rebuildHugo(config)
+		return
+	}
+	mu.Lock()
+	pending.pages[page] = struct{}{}
+	pending.lists = pending.lists || lists
+	mu.Unlock()
+	scheduleBuild(config)
+}
+
+// scheduleBuild (re)starts the idle timer; the pending build runs when it
+// expires, so every new request pushes the build back by idle_second. A full
+// build is also held back until rebuild_min_interval seconds have passed since
+// the previous one.
+func scheduleBuild(config Config) {
+	delay := time.Duration(config.IdleSecond) * time.Second
+	mu.Lock()
+	defer mu.Unlock()
+	if pending.full && config.RebuildMinInterval > 0 {
+		floor := time.Until(lastFullBuild.Add(time.Duration(config.RebuildMinInterval) * time.Second))
+		if floor > delay {
+			if buildTimer == nil {
+				slog.Info("Delaying full Hugo build, changes until then are built together",
+					"wait", floor.Round(time.Second), "rebuild_min_interval", config.RebuildMinInterval)
+			}
+			delay = floor
+		}
+	}
+	if buildTimer != nil {
+		buildTimer.Reset(delay)
+		return
+	}
+	buildTimer = time.AfterFunc(delay, func() { runPendingBuild(config) })
+}
+
+// runPendingBuild runs the accumulated build, waiting for any running one.
+func runPendingBuild(config Config) {
+	buildMux.Lock()
+	defer buildMux.Unlock()
+
+	mu.Lock()
+	b := pending
+	pending = pendingBuild{pages: make(map[string]struct{})}
+	if buildTimer != nil {
+		buildTimer.Stop()
+		buildTimer = nil
+	}
+	mu.Unlock()
+
+	if !b.empty() {
+		buildHugo(config, b)
+	}
+	if b.full {
+		mu.Lock()
+		lastFullBuild = time.Now()
+		mu.Unlock()
+	}
+}
+
+// stopHugoBuilds drops any debounced build and waits for a running one.
+func stopHugoBuilds() {
+	mu.Lock()
+	if buildTimer != nil {
+		buildTimer.Stop()
+		buildTimer = nil
+	}
+	mu.Unlock()
+	buildMux.Lock()
+	buildMux.Unlock()
+}
+
+func buildHugo(config Config, b pendingBuild) {
+	start := time.Now()
+	args := append([]string{"--source", ".", "--destination", config.HugoOutDir}, config.HugoArgs...)
+	mode := "full"
+	if !b.full {
+		segmentConfig, err := writeSegmentConfig(b)
+		siteConfig := hugoSiteConfig(config)
+		switch {
+		case err != nil:
+			slog.Warn("Writing Hugo segment config failed, falling back to full build", "err", err)
+		case siteConfig == "":
+			os.Remove(segmentConfig)
+			slog.Warn("No Hugo site config found, falling back to full build")
+		default:
+			defer os.Remove(segmentConfig)
+			args = append(args, "--config", siteConfig+","+segmentConfig, "--renderSegments", hugoSegmentName)
+			mode = fmt.Sprintf("partial (%d pages, lists=%v)", len(b.pages), b.lists)
+		}
+	}
+
+	slog.Info("Start building", "mode", mode)
+	cmd := exec.Command(config.HugoPath, args...)
+	cmd.Env = append(os.Environ(), config.HugoEnv...)
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err != nil {
+		slog.Error("Hugo build failed", "err", err, "output", output)
+	} else if output != "" {
+		slog.Debug("Hugo output", "output", output)
+	}
+	metrics.observeBuild(time.Since(start), err)
+	slog.Info("Hugo build finished", "mode", mode, "took", time.Since(start))
+}
+
+// hugoSiteConfig returns the Hugo site config file to merge the segment
+// config into, either from hugo_config or detected in the site root.
+func hugoSiteConfig(config Config) string {
+	if config.HugoConfig != "" {
+		return config.HugoConfig
+	}
+	for _, name := range []string{"hugo.toml", "hugo.yaml", "hugo.json", "config.toml", "config.yaml", "config.json"} {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// writeSegmentConfig writes a temporary Hugo config defining a segment that
+// matches only the pages in b. Rendering with --renderSegments leaves the rest
+// of the already built output untouched.
+func writeSegmentConfig(b pendingBuild) (string, error) {
+	pages := make([]string, 0, len(b.pages))
+	for page := range b.pages {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[segments.%s]\n", hugoSegmentName)
+	if len(pages) > 0 {
+		fmt.Fprintf(&sb, "[[segments.%s.includes]]\n", hugoSegmentName)
+		fmt.Fprintf(&sb, "path = %q\n", "{"+strings.Join(pages, ",")+"}")
+	}
+	if b.lists {
+		fmt.Fprintf(&sb, "[[segments.%s.includes]]\n", hugoSegmentName)
+		fmt.Fprintf(&sb, "kind = %q\n", "{home,section,taxonomy,term}")
+	}
+
+	f, err := os.CreateTemp("", "hugo_gallery_segment_*.toml")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(sb.String()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// hugoPagePath converts a markdown file under ContentDir to its Hugo page path.
+func hugoPagePath(config Config, postPath string) string {
+	rel, err := filepath.Rel(config.ContentDir, postPath)
+	if err != nil {
+		rel = filepath.Base(postPath)
+	}
+	return "/" + filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel)))
+}
+
+// hugoPageBuilt reports whether the rendered HTML for page already exists.
+func hugoPageBuilt(config Config, page string) bool {
+	_, err := os.Stat(filepath.Join(config.HugoOutDir, filepath.FromSlash(page), "index.html"))
+	return err == nil
+}
+
+// frontMatter returns the YAML front matter block of a markdown document.
+func frontMatter(md string) string {
+	rest, ok := strings.CutPrefix(md, "---")
+	if !ok {
+		return ""
+	}
+	if i := strings.Index(rest, "\n---"); i >= 0 {
+		return rest[:i]
+	}
+	return ""
+}
+
+// rebuildForPost triggers the smallest Hugo build covering a rewritten post.
+// An unchanged post that is already rendered needs no build at all, and a
+// post whose front matter is unchanged does not affect any list page.
+func rebuildForPost(config Config, postPath, oldContent, newContent string) {
+	page := hugoPagePath(config, postPath)
+	if config.HugoPartialRebuild && oldContent == newContent && hugoPageBuilt(config, page) {
+		slog.Debug("Post unchanged, skipping Hugo build", "page", page)
+		return
+	}
+	lists := oldContent == "" || frontMatter(oldContent) != frontMatter(newContent)
+	rebuildHugoPage(config, page, lists)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the per-folder file listing paths to exclude from the gallery.
+const ignoreFileName = ".galleryignore"
+
+// Patterns skipped when ignore_patterns is not set: dotfiles (including macOS
+// "._" resource forks) and the metadata folders of common NAS and OS tools.
+var defaultIgnorePatterns = []string{
+	".*", "@eaDir", "#recycle", "#snapshot", "$RECYCLE.BIN",
+	"System Volume Information", "lost+found", "Thumbs.db", "desktop.ini",
+}
+
+// ignoreRule is one pattern line of a .galleryignore file.
+type ignoreRule struct {
+	pattern  string // glob, relative to the ignore file's folder if anchored
+	anchored bool   // pattern contains a slash and matches the relative path
+	dirOnly  bool   // pattern ended in a slash and only matches folders
+	negate   bool   // pattern started with "!" and re-includes matches
+}
+
+// ignoreFile caches the parsed rules of one .galleryignore file.
+type ignoreFile struct {
+	modTime time.Time
+	rules   []ignoreRule
+}
+
+var (
+	ignoreCache    = make(map[string]*ignoreFile) // folder -> rules, nil if absent
+	ignoreCacheMux sync.Mutex
+)
+
+// parseIgnoreRules parses gitignore-style lines: "#" comments, "!" negation,
+// a trailing "/" for folders only, and a "/" elsewhere to anchor the pattern
+// to the folder holding the file.
+func parseIgnoreRules(lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// loadIgnoreRules returns the rules of dir's .galleryignore, re-reading the
+// file when it changed on disk.
+func loadIgnoreRules(dir string) []ignoreRule {
+	info, err := os.Stat(filepath.Join(dir, ignoreFileName))
+
+	ignoreCacheMux.Lock()
+	defer ignoreCacheMux.Unlock()
+	cached, ok := ignoreCache[dir]
+	if err != nil {
+		ignoreCache[dir] = nil
+		return nil
+	}
+	if ok && cached != nil && cached.modTime.Equal(info.ModTime()) {
+		return cached.rules
+	}
+
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	rules := parseIgnoreRules(lines)
+	ignoreCache[dir] = &ignoreFile{modTime: info.ModTime(), rules: rules}
+	return rules
+}
+
+// matchIgnoreRules applies rules from base to path; the last matching rule
+// wins. It returns whether any rule matched and whether path is ignored.
+func matchIgnoreRules(rules []ignoreRule, base, path string, isDir bool) (matched, ignored bool) {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return false, false
+	}
+	rel = filepath.ToSlash(rel)
+	name := filepath.Base(path)
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		target := name
+		if rule.anchored {
+			target = rel
+		}
+		if ok, _ := filepath.Match(rule.pattern, target); ok {
+			matched, ignored = true, !rule.negate
+		}
+	}
+	return matched, ignored
+}
+
+// ignoreMatcher applies ignore_patterns and .galleryignore files for one
+// scan: the patterns are parsed once, and each folder's .galleryignore is
+// read at most once instead of for every entry below it. Changes to the
+// files during the scan are seen by the next one. It is safe for concurrent
+// use.
+type ignoreMatcher struct {
+	root   string
+	global []ignoreRule
+
+	mu   sync.Mutex
+	dirs map[string][]ignoreRule // folder -> rules of its .galleryignore
+}
+
+func newIgnoreMatcher(config Config) *ignoreMatcher {
+	return &ignoreMatcher{
+		root:   filepath.Clean(config.WatchDir),
+		global: parseIgnoreRules(config.IgnorePatterns),
+		dirs:   make(map[string][]ignoreRule),
+	}
+}
+
+// dirRules returns the rules of dir's .galleryignore, loading them on first use.
+func (m *ignoreMatcher) dirRules(dir string) []ignoreRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules, ok := m.dirs[dir]
+	if !ok {
+		rules = loadIgnoreRules(dir)
+		m.dirs[dir] = rules
+	}
+	return rules
+}
+
+// ignored reports whether path is excluded by ignore_patterns or the
+// .galleryignore files of its ancestors up to WatchDir. Ancestor folders are
+// not checked; see isIgnoredPath.
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	ignored := false
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == m.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if dirs[len(dirs)-1] != m.root {
+		return false // outside WatchDir
+	}
+	// ignore_patterns apply first, so a .galleryignore can re-include with "!"
+	if _, ign := matchIgnoreRules(m.global, m.root, path, isDir); ign {
+		ignored = true
+	}
+	// Closer ignore files take precedence, as in gitignore
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if matched, ign := matchIgnoreRules(m.dirRules(dirs[i]), dirs[i], path, isDir); matched {
+			ignored = ign
+		}
+	}
+	return ignored
+}
+
+// isIgnoredPath reports whether path or any folder between it and WatchDir
+// is excluded by ignore_patterns or a .galleryignore file.
+func isIgnoredPath(config Config, path string, isDir bool) bool {
+	return newIgnoreMatcher(config).ignoredPath(path, isDir)
+}
+
+// ignoredPath is isIgnoredPath with the rules of m.
+func (m *ignoreMatcher) ignoredPath(path string, isDir bool) bool {
+	path = filepath.Clean(path)
+	if path == m.root {
+		return false
+	}
+	for dir := filepath.Dir(path); dir != m.root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if m.ignored(dir, true) {
+			return true
+		}
+	}
+	return m.ignored(path, isDir)
+}
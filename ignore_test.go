@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcherReadsEachIgnoreFileOncePerScan(t *testing.T) {
+	g := newTestGallery(t)
+	g.config.IgnorePatterns = defaultIgnorePatterns
+	album := filepath.Join(g.config.WatchDir, "Album")
+	if err := os.MkdirAll(filepath.Join(album, "Raw"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ignoreFile := filepath.Join(g.config.WatchDir, ignoreFileName)
+	if err := os.WriteFile(ignoreFile, []byte("*.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newIgnoreMatcher(g.config)
+	if !m.ignored(filepath.Join(album, "Raw", "a.tmp"), false) {
+		t.Error("a.tmp not ignored by the root .galleryignore")
+	}
+	if !m.ignored(filepath.Join(album, ".DS_Store"), false) {
+		t.Error(".DS_Store not ignored by ignore_patterns")
+	}
+	if m.ignored(filepath.Join(album, "a.jpg"), false) {
+		t.Error("a.jpg ignored")
+	}
+
+	// The matcher keeps the rules it read; a new one sees the change
+	if err := os.WriteFile(ignoreFile, []byte("*.jpg\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m.ignored(filepath.Join(album, "b.jpg"), false) {
+		t.Error("matcher re-read .galleryignore during its scan")
+	}
+	if !newIgnoreMatcher(g.config).ignored(filepath.Join(album, "b.jpg"), false) {
+		t.Error("new matcher missed the changed .galleryignore")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Fraction of max_cache_bytes the cache is trimmed down to once it overflows,
+// so eviction doesn't run again on every new file.
+const cacheLowWatermark = 0.9
+
+// cacheEntry is the bookkeeping kept for each file in the cache directory.
+type cacheEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// loadCacheIndex seeds the cache index from the files already on disk,
+// using their modification time as the last access.
+func (ip *ImageProcessor) loadCacheIndex() {
+	files, err := cacheFiles(ip.cacheDir)
+	if err != nil {
+		slog.Error("Reading cache directory failed", "err", err)
+		return
+	}
+	ip.cacheMux.Lock()
+	defer ip.cacheMux.Unlock()
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		ip.cacheIndex[file] = &cacheEntry{size: info.Size(), lastAccess: info.ModTime()}
+		ip.cacheBytes += info.Size()
+	}
+	slog.Info("Image cache loaded", "files", len(ip.cacheIndex), "bytes", ip.cacheBytes)
+}
+
+// cacheFiles lists the files in cacheDir and its shard subdirectories. A
+// cache written before sharding was enabled, or after it was disabled, is
+// listed too, so its files expire as usual.
+func cacheFiles(cacheDir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == cacheDir && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// touchCache records an access to a cached file.
+func (ip *ImageProcessor) touchCache(path string) {
+	ip.cacheMux.Lock()
+	defer ip.cacheMux.Unlock()
+	if entry, ok := ip.cacheIndex[path]; ok {
+		entry.lastAccess = time.Now()
+	}
+}
+
+// addCache records a newly written cache file and evicts the least recently
+// used files if the cache grew past maxCacheBytes.
+func (ip *ImageProcessor) addCache(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	ip.cacheMux.Lock()
+	if old, ok := ip.cacheIndex[path]; ok {
+		ip.cacheBytes -= old.size
+	}
+	ip.cacheIndex[path] = &cacheEntry{size: info.Size(), lastAccess: time.Now()}
+	ip.cacheBytes += info.Size()
+	over := ip.maxCacheBytes > 0 && ip.cacheBytes > ip.maxCacheBytes
+	ip.cacheMux.Unlock()
+
+	if over {
+		ip.evictLRU(path)
+	}
+}
+
+// removeCache forgets a cache file that was deleted from disk.
+func (ip *ImageProcessor) removeCache(path string) {
+	ip.cacheMux.Lock()
+	defer ip.cacheMux.Unlock()
+	if entry, ok := ip.cacheIndex[path]; ok {
+		ip.cacheBytes -= entry.size
+		delete(ip.cacheIndex, path)
+	}
+}
+
+// evictLRU removes the least recently accessed files until the cache is below
+// the low watermark. keep is never evicted since it is about to be served.
+// Only one eviction runs at a time; callers arriving meanwhile return at
+// once, as the running one frees the space.
+func (ip *ImageProcessor) evictLRU(keep string) {
+	if !ip.evicting.CompareAndSwap(false, true) {
+		return
+	}
+	defer ip.evicting.Store(false)
+
+	type candidate struct {
+		path       string
+		lastAccess time.Time
+	}
+	ip.cacheMux.Lock()
+	candidates := make([]candidate, 0, len(ip.cacheIndex))
+	for path, entry := range ip.cacheIndex {
+		if path != keep {
+			candidates = append(candidates, candidate{path, entry.lastAccess})
+		}
+	}
+	ip.cacheMux.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+	})
+
+	target := int64(float64(ip.maxCacheBytes) * cacheLowWatermark)
+	removed := 0
+	for _, c := range candidates {
+		if ip.CacheSize() <= target {
+			break
+		}
+		if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Removing cache file failed", "path", c.path, "err", err)
+			continue
+		}
+		ip.removeCache(c.path)
+		removed++
+	}
+	slog.Info("Evicted cache files", "files", removed, "bytes", ip.CacheSize())
+}
+
+// CacheSize returns the total size in bytes of the files in the cache.
+func (ip *ImageProcessor) CacheSize() int64 {
+	ip.cacheMux.Lock()
+	defer ip.cacheMux.Unlock()
+	return ip.cacheBytes
+}
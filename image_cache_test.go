@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkCleanCache times a cleanup of 20,000 cache files, half of them
+// expired. Evictions, which run after each resize once the cache is over
+// max_cache_bytes, are made meanwhile: evictions/op counts those that
+// finished during the cleanup, and max-evict-ns is the slowest one.
+func BenchmarkCleanCache(b *testing.B) {
+	ip := NewImageProcessor(Config{ImageCacheDir: b.TempDir(), ImageMaxConcurrent: 2})
+	ip.SetExpiration(time.Hour)
+	ip.maxCacheBytes = 1 << 40 // evictions find nothing to remove
+	old := time.Now().Add(-2 * time.Hour)
+
+	var maxEvict time.Duration
+	evictions := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 20000; j++ {
+			path := filepath.Join(ip.cacheDir, fmt.Sprintf("%02x", j%256), fmt.Sprintf("%d.jpg", j))
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+				b.Fatal(err)
+			}
+			if j%2 == 0 {
+				os.Chtimes(path, old, old)
+			}
+		}
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				start := time.Now()
+				ip.evictLRU("")
+				maxEvict = max(maxEvict, time.Since(start))
+				evictions++
+			}
+		}()
+		b.StartTimer()
+
+		ip.CleanCache()
+
+		b.StopTimer()
+		close(done)
+		wg.Wait()
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(evictions)/float64(b.N), "evictions/op")
+	b.ReportMetric(float64(maxEvict.Nanoseconds()), "max-evict-ns")
+}
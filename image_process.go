@@ -1,46 +1,273 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
 )
 
-func cache_image_hash(originalPath string, width int) string {
+// Output formats accepted for cached images, mapped to their file extension.
+var outputFormats = map[string]string{
+	"avif": ".avif",
+	"jpeg": ".jpg",
+	"jpg":  ".jpg",
+	"png":  ".png",
+	"webp": ".webp",
+}
+
+// Content types of the cached image extensions.
+var imageContentTypes = map[string]string{
+	".avif": "image/avif",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+}
+
+// parseOutputFormat validates a requested output format. The empty string
+// keeps the source format.
+func parseOutputFormat(format string) (string, error) {
+	format = strings.ToLower(format)
+	if format == "" {
+		return "", nil
+	}
+	if _, ok := outputFormats[format]; !ok {
+		return "", fmt.Errorf("unsupported output format %q", format)
+	}
+	return format, nil
+}
+
+// imageContentType returns the content type for an image path, or "" if unknown.
+func imageContentType(path string) string {
+	return imageContentTypes[strings.ToLower(filepath.Ext(path))]
+}
+
+// applyDPR multiplies the requested size by dpr for high-density screens,
+// but never beyond the size of the source at srcPath: a dpr request does not
+// enlarge small originals, even with allow_upscale.
+func applyDPR(srcPath string, opts ImageOptions, dpr float64) ImageOptions {
+	if dpr <= 1 || (opts.Width <= 0 && opts.Height <= 0) {
+		return opts
+	}
+	scale := dpr
+	if f, err := os.Open(srcPath); err == nil {
+		src, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err == nil {
+			if opts.Width > 0 {
+				scale = min(scale, float64(src.Width)/float64(opts.Width))
+			}
+			if opts.Height > 0 {
+				scale = min(scale, float64(src.Height)/float64(opts.Height))
+			}
+		}
+	}
+	if scale <= 1 {
+		return opts
+	}
+	opts.Width = int(math.Round(float64(opts.Width) * scale))
+	opts.Height = int(math.Round(float64(opts.Height) * scale))
+	return opts
+}
+
+// ImageOptions describes a cached variant of a source image.
+type ImageOptions struct {
+	Width   int    // target width, 0 to derive it from Height
+	Height  int    // target height, 0 to derive it from Width
+	Format  string // output format, empty keeps the source format
+	Quality int    // JPEG quality (1-100), 0 for the encoder default
+	Mode    string // resize mode, empty for a proportional resize
+
+	// StripMetadata re-encodes even unresized images so no EXIF/IPTC/XMP
+	// reaches the client, baking the EXIF orientation into the pixels.
+	StripMetadata bool
+
+	// SourceVersion identifies the source's size and mtime when
+	// image_cache_key_source is set, so a replaced source gets new variants.
+	SourceVersion string
+}
+
+// Resize modes accepted in ImageOptions.Mode.
+var resizeModes = map[string]bool{
+	"fit":  true, // scale down to fit inside the box
+	"fill": true, // scale and center-crop to fill the box exactly
+	"crop": true, // center-crop to the box without scaling
+}
+
+// resampleFilter is a resize filter selectable with resize_filter.
+type resampleFilter struct {
+	filter imaging.ResampleFilter
+	note   string // speed/quality tradeoff, logged at startup
+}
+
+var resampleFilters = map[string]resampleFilter{
+	"lanczos":    {imaging.Lanczos, "sharpest, slowest"},
+	"catmullrom": {imaging.CatmullRom, "sharp, noticeably faster than lanczos"},
+	"linear":     {imaging.Linear, "slightly soft, fast"},
+	"box":        {imaging.Box, "softest, fastest; fine for small thumbnails"},
+}
+
+// parseResizeMode validates a requested resize mode.
+func parseResizeMode(mode string) (string, error) {
+	mode = strings.ToLower(mode)
+	if mode != "" && !resizeModes[mode] {
+		return "", fmt.Errorf("unsupported resize mode %q", mode)
+	}
+	return mode, nil
+}
+
+// defaultImageOptions returns the options of requests that only set a size.
+func defaultImageOptions(config Config) ImageOptions {
+	return ImageOptions{
+		Format:        config.OutputFormat,
+		Quality:       config.JPEGQuality,
+		StripMetadata: config.StripMetadata,
+	}
+}
+
+// isOriginal reports whether the options leave the source unchanged.
+func (o ImageOptions) isOriginal() bool {
+	return o.Width <= 0 && o.Height <= 0 && o.Format == "" && !o.StripMetadata
+}
+
+// outputExt returns the extension of the variant generated from originalPath.
+func (o ImageOptions) outputExt(originalPath string) string {
+	if o.Format != "" {
+		return outputFormats[o.Format]
+	}
+	return strings.ToLower(filepath.Ext(originalPath))
+}
+
+// jpegQuality returns the JPEG quality to encode originalPath's variant
+// with, or 0 when the output isn't a JPEG.
+func (o ImageOptions) jpegQuality(originalPath string) int {
+	if ext := o.outputExt(originalPath); ext == ".jpg" || ext == ".jpeg" {
+		return o.Quality
+	}
+	return 0
+}
+
+func cache_image_hash(originalPath string, opts ImageOptions) string {
 	dir := filepath.Dir(originalPath)
 	dir_hash_hex := md5.Sum([]byte(dir))
 	dir_hash := hex.EncodeToString(dir_hash_hex[:])[:16]
 
 	file_name_without_ext := strings.TrimSuffix(filepath.Base(originalPath), filepath.Ext(originalPath))
-	hash := fmt.Sprintf("%s_%s_%d", dir_hash, file_name_without_ext, width)
+	hash := fmt.Sprintf("%s_%s_%d", dir_hash, file_name_without_ext, opts.Width)
+	if opts.Height > 0 {
+		hash = fmt.Sprintf("%s_h%d", hash, opts.Height)
+	}
+	if opts.Format != "" {
+		// Keep the source extension so a.jpg and a.png don't share a variant
+		src_ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(originalPath)), ".")
+		hash = fmt.Sprintf("%s_%s_%s", hash, src_ext, opts.Format)
+	}
+	if opts.Mode != "" {
+		hash = fmt.Sprintf("%s_%s", hash, opts.Mode)
+	}
+	if opts.StripMetadata {
+		hash += "_s"
+	}
+	if quality := opts.jpegQuality(originalPath); quality > 0 {
+		hash = fmt.Sprintf("%s_q%d", hash, quality)
+	}
+	if opts.SourceVersion != "" {
+		hash += "_v" + opts.SourceVersion
+	}
 	return hash
 }
 
-func cache_image_path(originalPath string, cacheDir string, width int) string {
-	if width <= 0 {
+// sourceVersion returns a short hash of the size and mtime of the source at
+// srcRelPath, or "" without image_cache_key_source or if it cannot be stated.
+func (ip *ImageProcessor) sourceVersion(srcRelPath string) string {
+	if !ip.cacheKeySource {
+		return ""
+	}
+	info, err := os.Stat(filepath.Join(ip.resourceDir, srcRelPath))
+	if err != nil {
+		return ""
+	}
+	sum := md5.Sum([]byte(fmt.Sprintf("%d_%d", info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func cache_image_path(originalPath string, cacheDir string, opts ImageOptions) string {
+	if opts.isOriginal() {
 		return originalPath
 	}
-	hash := cache_image_hash(originalPath, width)
-	ext := strings.ToLower(filepath.Ext(originalPath))
-	return filepath.Join(cacheDir, fmt.Sprintf("%s%s", hash, ext))
+	hash := cache_image_hash(originalPath, opts)
+	return cacheFile(cacheDir, fmt.Sprintf("%s%s", hash, opts.outputExt(originalPath)))
+}
+
+// cacheSharded is set from image_cache_sharding. Cache files then live in
+// subdirectories named after the first two hex characters of their hash, so
+// no directory grows to hundreds of thousands of entries.
+var cacheSharded bool
+
+// cacheFile returns the path of the cache file name in cacheDir.
+func cacheFile(cacheDir, name string) string {
+	if cacheSharded && len(name) > 2 {
+		return filepath.Join(cacheDir, name[:2], name)
+	}
+	return filepath.Join(cacheDir, name)
 }
 
+// errTooManyResizes is returned when no processing slot is free; the job
+// continues in the background.
+var errTooManyResizes = errors.New("too many concurrent resizes")
+
+// errNoUpscale is returned by resizeImage when the requested size isn't
+// smaller than the source and the original should be served instead.
+var errNoUpscale = errors.New("requested size exceeds source")
+
+// errUnsupportedImage marks sources that can't be decoded: unknown formats
+// and corrupt or truncated files, as opposed to files that can't be read.
+var errUnsupportedImage = errors.New("unsupported source image")
+
 type ImageProcessor struct {
-	cacheDir      string
-	resourceDir   string
-	expiration    time.Duration
-	maxConcurrent int
-	processMux    sync.RWMutex    // protects cache operations
-	jobSemaphore  chan struct{}   // limits total concurrent jobs
-	activeJobs    map[string]*Job // tracks jobs by unique key
-	jobsMux       sync.RWMutex    // protects activeJobs map
+	cacheDir         string
+	resourceDir      string
+	expiration       atomic.Int64 // cache lifetime in nanoseconds, see SetExpiration
+	maxConcurrent    int
+	ffmpegPath       string                 // ffmpeg binary for video thumbnails
+	ffmpegOnce       sync.Once              // guards the ffmpeg lookup
+	ffmpegFound      bool                   // whether ffmpegPath resolves to a binary
+	evicting         atomic.Bool            // an LRU eviction is running
+	jobSemaphore     chan struct{}          // limits total concurrent jobs
+	activeJobs       map[string]*Job        // tracks jobs by unique key
+	jobsMux          sync.RWMutex           // protects activeJobs map
+	allowUpscale     bool                   // resize images beyond their source size
+	defaults         ImageOptions           // options of requests without overrides
+	allowedWidths    []int                  // sorted widths requests snap to, nil for any
+	precomputeWidths []int                  // widths pregenerated for new folders
+	precomputeQueue  chan precomputeJob     // folders waiting for pregeneration
+	maxCacheBytes    int64                  // evict LRU files above this size, 0 for no limit
+	cacheKeySource   bool                   // key variants on the source's size and mtime too
+	openRetries      int                    // extra attempts at reading a source after an I/O error
+	cacheIndex       map[string]*cacheEntry // size and last access of cached files
+	cacheBytes       int64                  // total size of cacheIndex
+	cacheMux         sync.Mutex             // protects cacheIndex and cacheBytes
+	stats            imageStats             // hit/miss/job counters
+	filter           imaging.ResampleFilter // resampling filter for resizes
 }
 
 type Job struct {
@@ -49,95 +276,234 @@ type Job struct {
 	Error error         // any error during processing
 }
 
-func NewImageProcessor(cacheDir, resourceDir string, expiration time.Duration, maxConcurrent int) *ImageProcessor {
-	return &ImageProcessor{
-		cacheDir:      cacheDir,
-		resourceDir:   resourceDir,
-		expiration:    expiration,
-		maxConcurrent: maxConcurrent,
-		jobSemaphore:  make(chan struct{}, maxConcurrent),
-		activeJobs:    make(map[string]*Job),
+func NewImageProcessor(config Config) *ImageProcessor {
+	maxConcurrent := config.ImageMaxConcurrent
+	ip := &ImageProcessor{
+		cacheDir:         config.ImageCacheDir,
+		resourceDir:      config.ImageRoot,
+		maxConcurrent:    maxConcurrent,
+		ffmpegPath:       config.FFmpegPath,
+		jobSemaphore:     make(chan struct{}, maxConcurrent),
+		activeJobs:       make(map[string]*Job),
+		allowUpscale:     config.AllowUpscale,
+		defaults:         defaultImageOptions(config),
+		allowedWidths:    config.AllowedWidths,
+		precomputeWidths: config.PrecomputeWidths,
+		precomputeQueue:  make(chan precomputeJob, 1024),
+		maxCacheBytes:    config.MaxCacheBytes,
+		cacheKeySource:   config.ImageCacheKeySource,
+		openRetries:      config.ImageOpenRetries,
+		cacheIndex:       make(map[string]*cacheEntry),
 	}
+	cacheSharded = config.ImageCacheSharding
+	ip.SetExpiration(time.Duration(config.ImageCacheExpirationMinutes) * time.Minute)
+	filter := resampleFilters[config.ResizeFilter]
+	ip.filter = filter.filter
+	slog.Info("Resize filter", "filter", config.ResizeFilter, "note", filter.note)
+
+	ip.loadCacheIndex()
+	if len(ip.precomputeWidths) > 0 {
+		go ip.runPrecompute()
+	}
+	return ip
 }
 
-func (ip *ImageProcessor) ProcessImage(srcRelPath string, width int) (string, error) {
+// ProcessImage returns the path of the variant of srcRelPath described by
+// opts, generating and caching it if needed.
+func (ip *ImageProcessor) ProcessImage(ctx context.Context, srcRelPath string, opts ImageOptions) (string, error) {
 	srcPath := filepath.Join(ip.resourceDir, srcRelPath)
-	if width <= 0 {
+	opts = ip.variantOptions(srcRelPath, opts)
+	cachedPath := ip.cachePath(srcRelPath, opts)
+	if cachedPath == "" || ip.servesOriginal(srcPath, opts) {
+		return srcPath, nil
+	}
+
+	path, err := ip.generate(ctx, cachedPath, srcPath, func() error {
+		return ip.resizeImage(srcPath, cachedPath, opts)
+	})
+	if errors.Is(err, errNoUpscale) {
 		return srcPath, nil
 	}
+	return path, err
+}
 
-	cachedPath := cache_image_path(srcRelPath, ip.cacheDir, width)
+// servesOriginal reports whether opts ask for the source at srcPath enlarged
+// without re-encoding it, which serves the original unless allow_upscale is
+// set. Only the image header is read, so such requests neither decode the
+// source nor wait for a processing slot. Sources whose header can't be read
+// are left to resizeImage.
+func (ip *ImageProcessor) servesOriginal(srcPath string, opts ImageOptions) bool {
+	if ip.allowUpscale || opts.Format != "" || opts.StripMetadata {
+		return false
+	}
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return false
+	}
+	return exceedsSource(cfg.Width, cfg.Height, opts)
+}
 
+// variantOptions returns the options of the variant actually generated for
+// opts: without a format that matches the source's, with the width snapped to
+// allowed_widths, and with the sniffed format for a source without an
+// extension, which saveImage could not otherwise pick an encoder for.
+func (ip *ImageProcessor) variantOptions(srcRelPath string, opts ImageOptions) ImageOptions {
+	if opts.Format != "" && outputFormats[opts.Format] == strings.ToLower(filepath.Ext(srcRelPath)) {
+		opts.Format = ""
+	}
+	if width := ip.snapWidth(opts.Width); width != opts.Width {
+		if opts.Height > 0 {
+			opts.Height = max(1, int(math.Round(float64(opts.Height)*float64(width)/float64(opts.Width))))
+		}
+		opts.Width = width
+	}
+	if opts.Format == "" && !opts.isOriginal() && filepath.Ext(srcRelPath) == "" {
+		opts.Format = sniffFormat(filepath.Join(ip.resourceDir, srcRelPath))
+	}
+	if !opts.isOriginal() {
+		opts.SourceVersion = ip.sourceVersion(srcRelPath)
+	}
+	return opts
+}
+
+// sniffFormat returns the output format closest to the content of the image
+// at path: png for lossless sources, webp for WebP and jpeg otherwise.
+func sniffFormat(path string) string {
+	buf := make([]byte, 512)
+	n := 0
+	if f, err := os.Open(path); err == nil {
+		n, _ = io.ReadFull(f, buf)
+		f.Close()
+	}
+	switch http.DetectContentType(buf[:n]) {
+	case "image/png", "image/gif", "image/bmp":
+		return "png"
+	case "image/webp":
+		return "webp"
+	}
+	return "jpeg"
+}
+
+// snapWidth returns the allowed width nearest to width, the larger one on a
+// tie. Widths of 0 and any width without allowed_widths are kept.
+func (ip *ImageProcessor) snapWidth(width int) int {
+	if width <= 0 || len(ip.allowedWidths) == 0 {
+		return width
+	}
+	i, _ := slices.BinarySearch(ip.allowedWidths, width)
+	if i == len(ip.allowedWidths) {
+		return ip.allowedWidths[i-1]
+	}
+	if i > 0 && width-ip.allowedWidths[i-1] < ip.allowedWidths[i]-width {
+		return ip.allowedWidths[i-1]
+	}
+	return ip.allowedWidths[i]
+}
+
+// variantPath returns the cache file of the variant opts ask for, or "" when
+// they ask for the original.
+func (ip *ImageProcessor) variantPath(srcRelPath string, opts ImageOptions) string {
+	return ip.cachePath(srcRelPath, ip.variantOptions(srcRelPath, opts))
+}
+
+// cachePath is variantPath for options variantOptions already returned.
+func (ip *ImageProcessor) cachePath(srcRelPath string, opts ImageOptions) string {
+	if opts.isOriginal() {
+		return ""
+	}
+	return cache_image_path(srcRelPath, ip.cacheDir, opts)
+}
+
+// generate returns cachedPath, running work to create it if it isn't cached
+// yet. Concurrent callers for the same path share one job, and jobs are
+// limited by jobSemaphore. On failure, fallback is returned with the error.
+// When ctx is cancelled the caller stops waiting with ctx.Err(), but the job
+// runs on and caches its result for the next caller.
+func (ip *ImageProcessor) generate(ctx context.Context, cachedPath, fallback string, work func() error) (string, error) {
 	// Quick check if already cached
 	if _, err := os.Stat(cachedPath); err == nil {
+		ip.stats.hits.Add(1)
+		ip.touchCache(cachedPath)
 		return cachedPath, nil
 	}
 
-	// Create unique job key
-	jobKey := fmt.Sprintf("%s_%d", srcRelPath, width)
-
-	// Check for existing job or create new one
+	// Join the job for this path or create it. A job that finished since
+	// the check above has written its file before leaving activeJobs, so
+	// look again under the lock rather than running the work twice.
 	ip.jobsMux.Lock()
-	job, exists := ip.activeJobs[jobKey]
-	if exists {
-		ip.jobsMux.Unlock()
-		// Wait for existing job
-		<-job.Done
-		return job.Path, job.Error
+	job, exists := ip.activeJobs[cachedPath]
+	if !exists {
+		if _, err := os.Stat(cachedPath); err == nil {
+			ip.jobsMux.Unlock()
+			ip.stats.hits.Add(1)
+			ip.touchCache(cachedPath)
+			return cachedPath, nil
+		}
+		job = &Job{Done: make(chan struct{})}
+		ip.activeJobs[cachedPath] = job
 	}
-
-	// Create new job
-	job = &Job{Done: make(chan struct{})}
-	ip.activeJobs[jobKey] = job
 	ip.jobsMux.Unlock()
+	ip.stats.misses.Add(1)
 
-	// Try to acquire processing slot immediately
-	select {
-	case ip.jobSemaphore <- struct{}{}:
-		// Got slot immediately, process normally
-	default:
-		// No slot available, start background job and return 429
-		go func() {
-			// Wait for a slot
-			ip.jobSemaphore <- struct{}{}
-			defer func() { <-ip.jobSemaphore }()
-
-			// Process image
-			srcPath := filepath.Join(ip.resourceDir, srcRelPath)
-			if err := ip.resizeImage(srcPath, cachedPath, width); err != nil {
-				job.Error = err
-			} else {
-				job.Path = cachedPath
-			}
-
-			// Clean up
-			close(job.Done)
-			ip.jobsMux.Lock()
-			delete(ip.activeJobs, jobKey)
-			ip.jobsMux.Unlock()
-		}()
+	if !exists {
+		// Try to acquire processing slot immediately
+		select {
+		case ip.jobSemaphore <- struct{}{}:
+			go ip.runJob(cachedPath, job, work)
+		default:
+			// No slot available, queue the job and return 429
+			go func() {
+				ip.jobSemaphore <- struct{}{}
+				ip.runJob(cachedPath, job, work)
+			}()
+			ip.stats.busy.Add(1)
+			return fallback, errTooManyResizes
+		}
+	}
 
-		return srcPath, fmt.Errorf("too many concurrent resizes")
+	select {
+	case <-job.Done:
+		if job.Error != nil {
+			return fallback, job.Error
+		}
+		return job.Path, nil
+	case <-ctx.Done():
+		return fallback, ctx.Err()
 	}
-	defer func() { <-ip.jobSemaphore }()
+}
 
-	// Process image immediately since we got a slot
+// runJob runs work for the job of cachedPath in a slot the caller acquired,
+// then releases the slot and publishes the result to the job's waiters.
+func (ip *ImageProcessor) runJob(cachedPath string, job *Job, work func() error) {
+	defer func() { <-ip.jobSemaphore }()
 
-	if err := ip.resizeImage(srcPath, cachedPath, width); err != nil {
+	start := time.Now()
+	err := work()
+	ip.stats.observeJob(time.Since(start), err)
+	if err != nil {
 		job.Error = err
-		close(job.Done)
-		return srcPath, err
+	} else {
+		job.Path = cachedPath
+		ip.addCache(cachedPath)
 	}
 
-	job.Path = cachedPath
+	// Waiters read job.Path and job.Error after Done is closed; callers
+	// arriving after the delete find the file instead.
+	ip.jobsMux.Lock()
+	delete(ip.activeJobs, cachedPath)
+	ip.jobsMux.Unlock()
 	close(job.Done)
-	return cachedPath, nil
 }
 
-func (ip *ImageProcessor) resizeImage(srcPath, destPath string, width int) error {
-	src, err := imaging.Open(srcPath)
+func (ip *ImageProcessor) resizeImage(srcPath, destPath string, opts ImageOptions) error {
+	src, err := ip.openSource(srcPath, opts.StripMetadata)
 	if err != nil {
-		return fmt.Errorf("failed to open source image: %w", err)
+		return err
 	}
 
 	// Create cache directory if needed
@@ -145,49 +511,274 @@ func (ip *ImageProcessor) resizeImage(srcPath, destPath string, width int) error
 		return fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
-	dst := imaging.Resize(src, width, 0, imaging.Lanczos)
-	if err := imaging.Save(dst, destPath); err != nil {
+	if !ip.allowUpscale {
+		if exceedsSource(src.Bounds().Dx(), src.Bounds().Dy(), opts) {
+			if opts.Format == "" && !opts.StripMetadata {
+				return errNoUpscale
+			}
+			// Still re-encode, but at the source size
+			opts.Width, opts.Height = 0, 0
+		}
+		opts = shrinkFillBox(src, opts)
+	}
+
+	dst := resize(src, opts, ip.filter)
+	if err := saveImage(dst, destPath, opts.Format, opts.jpegQuality(srcPath)); err != nil {
 		return fmt.Errorf("failed to save resized image: %w", err)
 	}
 
 	return nil
 }
 
-func (ip *ImageProcessor) CleanCache() {
-	// Use write lock to prevent concurrent processing
-	ip.processMux.Lock()
-	defer ip.processMux.Unlock()
+// openSourceFile opens a source image for openImage; tests replace it to
+// simulate failing reads.
+var openSourceFile = func(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+// openImage decodes the image at path. Errors decoding it wrap
+// errUnsupportedImage, while errors reading the file are returned as they are.
+func openImage(path string, autoOrient bool) (image.Image, error) {
+	f, err := openSourceFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source image: %w", err)
+	}
+	defer f.Close()
+	// The decoders report some read errors as a bad format, so note them
+	// on the way in
+	r := &readErrRecorder{r: f}
+	img, err := imaging.Decode(r, imaging.AutoOrientation(autoOrient))
+	if err != nil {
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to read source image: %w", r.err)
+		}
+		return nil, fmt.Errorf("%w: %v", errUnsupportedImage, err)
+	}
+	return img, nil
+}
+
+// readErrRecorder keeps the first error other than io.EOF its reader returns.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF && rr.err == nil {
+		rr.err = err
+	}
+	return n, err
+}
+
+// First wait before retrying a source that failed to read; it doubles with
+// every further attempt.
+const openRetryBackoff = 100 * time.Millisecond
+
+// openSource opens a source image like openImage, retrying up to
+// image_open_retries times with a growing pause when reading it fails, as
+// busy network mounts sometimes do. Missing or unreadable files and images
+// that can't be decoded fail at once.
+func (ip *ImageProcessor) openSource(path string, autoOrient bool) (image.Image, error) {
+	backoff := openRetryBackoff
+	for attempt := 0; ; attempt++ {
+		img, err := openImage(path, autoOrient)
+		if err == nil || attempt >= ip.openRetries || !retryableOpenError(err) {
+			return img, err
+		}
+		slog.Debug("Reading source image failed, retrying", "path", path, "attempt", attempt+1, "wait", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func retryableOpenError(err error) bool {
+	return !errors.Is(err, errUnsupportedImage) && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission)
+}
+
+// exceedsSource reports whether resizing a dx x dy source per opts would
+// enlarge it.
+func exceedsSource(dx, dy int, opts ImageOptions) bool {
+	if opts.Mode == "fill" || opts.Mode == "crop" {
+		return false
+	}
+	switch {
+	case opts.Width > 0 && opts.Height > 0:
+		return opts.Width >= dx && opts.Height >= dy
+	case opts.Width > 0:
+		return opts.Width >= dx
+	case opts.Height > 0:
+		return opts.Height >= dy
+	}
+	return false
+}
 
-	files, err := filepath.Glob(filepath.Join(ip.cacheDir, "*"))
+// shrinkFillBox scales a fill box that is larger than src down to fit inside
+// it, keeping the box's aspect ratio, so filling never enlarges the image.
+func shrinkFillBox(src image.Image, opts ImageOptions) ImageOptions {
+	if opts.Mode != "fill" || opts.Width <= 0 || opts.Height <= 0 {
+		return opts
+	}
+	dx, dy := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	scale := min(dx/float64(opts.Width), dy/float64(opts.Height))
+	if scale < 1 {
+		opts.Width = max(1, int(float64(opts.Width)*scale))
+		opts.Height = max(1, int(float64(opts.Height)*scale))
+	}
+	return opts
+}
+
+// resize applies the dimensions and mode of opts to src. Fill and crop use
+// a square box when only one dimension is given.
+func resize(src image.Image, opts ImageOptions, filter imaging.ResampleFilter) image.Image {
+	width, height := opts.Width, opts.Height
+	if width <= 0 && height <= 0 {
+		return src
+	}
+	switch opts.Mode {
+	case "fill", "crop":
+		if width <= 0 {
+			width = height
+		}
+		if height <= 0 {
+			height = width
+		}
+		if opts.Mode == "fill" {
+			return imaging.Fill(src, width, height, imaging.Center, filter)
+		}
+		return imaging.CropCenter(src, width, height)
+	}
+	if width > 0 && height > 0 {
+		return imaging.Fit(src, width, height, filter)
+	}
+	return imaging.Resize(src, width, height, filter)
+}
+
+// saveImage encodes img to path. Formats imaging can't encode are handled
+// here; everything else is left to imaging.Save, which infers it from the
+// extension.
+func saveImage(img image.Image, path string, format string, jpegQuality int) error {
+	var encode func(io.Writer, image.Image) error
+	switch format {
+	case "webp":
+		encode = func(w io.Writer, img image.Image) error {
+			return webp.Encode(w, img, &webp.Options{Quality: 80})
+		}
+	case "avif":
+		encode = func(w io.Writer, img image.Image) error {
+			return avif.Encode(w, img, avif.Options{Quality: avif.DefaultQuality, Speed: avif.DefaultSpeed})
+		}
+	default:
+		if jpegQuality > 0 {
+			return imaging.Save(img, path, imaging.JPEGQuality(jpegQuality))
+		}
+		return imaging.Save(img, path)
+	}
+
+	f, err := os.Create(path)
 	if err != nil {
-		fmt.Printf("Error reading cache directory: %v\n", err)
+		return err
+	}
+	if err := encode(f, img); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// Workers stating and removing files during a cache cleanup.
+const cacheCleanupWorkers = 8
+
+// CleanCache removes the cache files older than the expiration. The files are
+// checked by a pool of workers. Requests go on being served meanwhile: a
+// file open for serving stays readable once removed, and one removed before
+// it is opened is generated again by the next request.
+func (ip *ImageProcessor) CleanCache() {
+	files, err := cacheFiles(ip.cacheDir)
+	if err != nil {
+		slog.Error("Reading cache directory failed", "err", err)
 		return
 	}
-	now := time.Now()
-	for _, file := range files {
-		info, err := os.Stat(file)
-		if err != nil {
-			fmt.Printf("Error stating file %s: %v\n", file, err)
-			continue
-		}
-		if now.Sub(info.ModTime()) > ip.expiration {
-			err := os.Remove(file)
-			if err != nil {
-				fmt.Printf("Error removing file %s: %v\n", file, err)
-			} else {
-				fmt.Printf("Removed expired cache file: %s\n", file)
+	cutoff := time.Now().Add(-ip.Expiration())
+
+	paths := make(chan string)
+	var removed atomic.Int64
+	var wg sync.WaitGroup
+	for range min(cacheCleanupWorkers, len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range paths {
+				if ip.removeExpired(file, cutoff) {
+					removed.Add(1)
+				}
 			}
+		}()
+	}
+	for _, file := range files {
+		paths <- file
+	}
+	close(paths)
+	wg.Wait()
+	slog.Info("Cache cleanup finished", "removed", removed.Load(), "bytes", ip.CacheSize())
+}
+
+// removeExpired removes a cache file last written before cutoff and reports
+// whether it did.
+func (ip *ImageProcessor) removeExpired(file string, cutoff time.Time) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Stating cache file failed", "path", file, "err", err)
 		}
+		return false
+	}
+	if !info.ModTime().Before(cutoff) {
+		return false
 	}
+	if err := os.Remove(file); err != nil {
+		if os.IsNotExist(err) {
+			return false // evicted meanwhile
+		}
+		slog.Error("Removing cache file failed", "path", file, "err", err)
+		return false
+	}
+	ip.removeCache(file)
+	slog.Debug("Removed expired cache file", "path", file)
+	return true
+}
+
+// Wait blocks until the running jobs finish by taking every jobSemaphore slot.
+// Later jobs see no free slot, so nothing new starts afterwards.
+func (ip *ImageProcessor) Wait(ctx context.Context) error {
+	for i := 0; i < cap(ip.jobSemaphore); i++ {
+		select {
+		case ip.jobSemaphore <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// SetExpiration changes how long cached files live; it may be called while
+// the processor is running.
+func (ip *ImageProcessor) SetExpiration(d time.Duration) {
+	ip.expiration.Store(int64(d))
+}
+
+func (ip *ImageProcessor) Expiration() time.Duration {
+	return time.Duration(ip.expiration.Load())
 }
 
-func (ip *ImageProcessor) ServeProcessedImage(srcRelPath string, width int) (string, error) {
-	return ip.ProcessImage(srcRelPath, width)
+func (ip *ImageProcessor) ServeProcessedImage(ctx context.Context, srcRelPath string, opts ImageOptions) (string, error) {
+	return ip.ProcessImage(ctx, srcRelPath, opts)
 }
 
+// StartCleanupRoutine cleans the cache now and then every interval.
 func (ip *ImageProcessor) StartCleanupRoutine(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
+		ip.CleanCache()
 		for range ticker.C {
 			ip.CleanCache()
 		}
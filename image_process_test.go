@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// TestGenerateSharesOneJob runs concurrent requests for one variant, with a
+// free slot and with every slot taken, and checks that the work runs once
+// and each caller either gets the file or is told to retry.
+func TestGenerateSharesOneJob(t *testing.T) {
+	for _, busy := range []bool{false, true} {
+		ip := NewImageProcessor(Config{ImageCacheDir: t.TempDir(), ImageMaxConcurrent: 1})
+		cachedPath := filepath.Join(ip.cacheDir, "variant.jpg")
+		var runs atomic.Int32
+		work := func() error {
+			runs.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			return os.WriteFile(cachedPath, []byte("x"), 0644)
+		}
+		if busy {
+			ip.jobSemaphore <- struct{}{}
+		}
+
+		var wg sync.WaitGroup
+		var served, retry atomic.Int32
+		for range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path, err := ip.generate(context.Background(), cachedPath, "fallback", work)
+				switch {
+				case errors.Is(err, errTooManyResizes):
+					retry.Add(1)
+				case err != nil || path != cachedPath:
+					t.Errorf("busy=%v: generate = %q, %v, want %q", busy, path, err, cachedPath)
+				default:
+					served.Add(1)
+				}
+			}()
+		}
+		if busy {
+			time.Sleep(20 * time.Millisecond)
+			<-ip.jobSemaphore // let the queued job run
+		}
+		wg.Wait()
+
+		if got := runs.Load(); got != 1 {
+			t.Errorf("busy=%v: work ran %d times, want 1", busy, got)
+		}
+		if busy && retry.Load() != 1 {
+			t.Errorf("busy=%v: %d callers told to retry, want only the one that queued the job", busy, retry.Load())
+		}
+		if !busy && retry.Load() != 0 {
+			t.Errorf("busy=%v: %d callers told to retry, want 0", busy, retry.Load())
+		}
+		if served.Load()+retry.Load() != 50 {
+			t.Errorf("busy=%v: %d callers served, %d retried, want 50 in all", busy, served.Load(), retry.Load())
+		}
+	}
+}
+
+func TestReplacedSourceYieldsFreshThumbnail(t *testing.T) {
+	g := newTestGallery(t)
+	config := g.config
+	config.ImageCacheKeySource = true
+	ip := NewImageProcessor(config)
+	g.addFolder(t, "Album", map[string][]byte{"a.jpg": testJPEG(t, 64, 64, color.White)})
+	src := filepath.Join(config.WatchDir, "Album", "a.jpg")
+	opts := defaultImageOptions(config)
+	opts.Width = 32
+
+	thumbnail := func() (string, color.Color) {
+		t.Helper()
+		path, err := ip.ProcessImage(context.Background(), "Album/a.jpg", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := imaging.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path, img.At(16, 16)
+	}
+	oldPath, _ := thumbnail()
+
+	if err := os.WriteFile(src, testJPEG(t, 64, 64, color.Black), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(src, later, later); err != nil {
+		t.Fatal(err)
+	}
+	newPath, c := thumbnail()
+	if newPath == oldPath {
+		t.Fatalf("replaced source is served from the old variant %s", oldPath)
+	}
+	if r, _, _, _ := c.RGBA(); r > 0x1000 {
+		t.Errorf("thumbnail of the replaced source is not black: %v", c)
+	}
+}
+
+// flakyReader returns the first n bytes of its data, then fails.
+type flakyReader struct {
+	data []byte
+	n    int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, syscall.EIO
+	}
+	n := copy(p, r.data[:min(r.n, len(r.data))])
+	r.data, r.n = r.data[n:], r.n-n
+	return n, nil
+}
+
+func (r *flakyReader) Close() error { return nil }
+
+func TestOpenSourceRetries(t *testing.T) {
+	jpg := testJPEG(t, 8, 8, color.White)
+	tests := []struct {
+		name     string
+		retries  int
+		failures int   // reads failing before one succeeds
+		openErr  error // error of every open instead, if set
+		wantErr  bool
+		attempts int
+	}{
+		{"succeeds at once", 2, 0, nil, false, 1},
+		{"fails N-1 times then succeeds", 2, 2, nil, false, 3},
+		{"gives up", 2, 3, nil, true, 3},
+		{"no retries", 0, 1, nil, true, 1},
+		{"missing file is not retried", 2, 0, fs.ErrNotExist, true, 1},
+		{"permission denied is not retried", 2, 0, fs.ErrPermission, true, 1},
+	}
+	defer func(open func(string) (io.ReadCloser, error)) { openSourceFile = open }(openSourceFile)
+	for _, tt := range tests {
+		attempts := 0
+		openSourceFile = func(path string) (io.ReadCloser, error) {
+			attempts++
+			if tt.openErr != nil {
+				return nil, tt.openErr
+			}
+			if attempts <= tt.failures {
+				return &flakyReader{data: jpg, n: 100}, nil
+			}
+			return io.NopCloser(bytes.NewReader(jpg)), nil
+		}
+		ip := &ImageProcessor{openRetries: tt.retries}
+		img, err := ip.openSource("a.jpg", false)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && img.Bounds().Dx() != 8 {
+			t.Errorf("%s: decoded %v, want an 8x8 image", tt.name, img.Bounds())
+		}
+		if err != nil && errors.Is(err, errUnsupportedImage) {
+			t.Errorf("%s: read error reported as unsupported image: %v", tt.name, err)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, attempts, tt.attempts)
+		}
+	}
+}
+
+// withEXIF returns jpg with an APP1 EXIF segment holding an empty IFD.
+func withEXIF(jpg []byte) []byte {
+	payload := []byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	segment := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append([]byte{}, jpg[:2]...) // SOI
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, jpg[2:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	g := newTestGallery(t)
+	src := withEXIF(testJPEG(t, 16, 16, color.White))
+	g.addFolder(t, "Album", map[string][]byte{"a.jpg": src})
+	if !bytes.Contains(src, []byte("Exif\x00")) {
+		t.Fatal("test photo has no EXIF segment")
+	}
+
+	tests := []struct {
+		name   string
+		width  int
+		format string
+	}{
+		{"unresized jpeg", 0, ""},
+		{"resized jpeg", 8, ""},
+		{"png", 8, "png"},
+		{"webp", 8, "webp"},
+	}
+	for _, tt := range tests {
+		opts := defaultImageOptions(g.config)
+		opts.StripMetadata = true
+		opts.Width = tt.width
+		opts.Format = tt.format
+		path, err := g.ip.ProcessImage(context.Background(), "Album/a.jpg", opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if path == filepath.Join(g.config.WatchDir, "Album", "a.jpg") {
+			t.Errorf("%s: the original was served", tt.name)
+			continue
+		}
+		out, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, marker := range []string{"Exif\x00", "eXIf", "EXIF"} {
+			if bytes.Contains(out, []byte(marker)) {
+				t.Errorf("%s: output contains %q", tt.name, marker)
+			}
+		}
+	}
+}
+
+func TestNoUpscaleWritesNoCacheFile(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		allowUpscale  bool
+		wantOriginal  bool
+	}{
+		{"wider than source", 32, 0, false, true},
+		{"as wide as source", 16, 0, false, true},
+		{"taller than source", 0, 32, false, true},
+		{"box larger than source", 32, 32, false, true},
+		{"narrower than source", 8, 0, false, false},
+		{"upscaling allowed", 32, 0, true, false},
+	}
+	for _, tt := range tests {
+		g := newTestGallery(t)
+		config := g.config
+		config.AllowUpscale = tt.allowUpscale
+		ip := NewImageProcessor(config)
+		g.addFolder(t, "Album", map[string][]byte{"a.jpg": testJPEG(t, 16, 16, color.White)})
+		opts := defaultImageOptions(config)
+		opts.Width, opts.Height = tt.width, tt.height
+
+		path, err := ip.ProcessImage(context.Background(), "Album/a.jpg", opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		original := filepath.Join(config.WatchDir, "Album", "a.jpg")
+		if (path == original) != tt.wantOriginal {
+			t.Errorf("%s: served %s, want original %v", tt.name, path, tt.wantOriginal)
+		}
+		wantFiles := 1
+		if tt.wantOriginal {
+			wantFiles = 0
+		}
+		files, _ := cacheFiles(config.ImageCacheDir)
+		if len(files) != wantFiles {
+			t.Errorf("%s: %d cache files written, want %d", tt.name, len(files), wantFiles)
+		}
+	}
+}
+
+func TestNoUpscaleServesOriginalWhenBusy(t *testing.T) {
+	g := newTestGallery(t)
+	g.addFolder(t, "Album", map[string][]byte{"a.jpg": testJPEG(t, 16, 16, color.White)})
+	for i := 0; i < cap(g.ip.jobSemaphore); i++ {
+		g.ip.jobSemaphore <- struct{}{}
+	}
+	opts := defaultImageOptions(g.config)
+	opts.Width = 32
+
+	path, err := g.ip.ProcessImage(context.Background(), "Album/a.jpg", opts)
+	if err != nil {
+		t.Fatalf("ProcessImage with every slot taken: %v", err)
+	}
+	if want := filepath.Join(g.config.WatchDir, "Album", "a.jpg"); path != want {
+		t.Errorf("served %s, want the original %s", path, want)
+	}
+	if misses := g.ip.stats.misses.Load(); misses != 0 {
+		t.Errorf("%d cache misses, want none", misses)
+	}
+}
+
+func TestGenerateCancelStopsWaiting(t *testing.T) {
+	tests := []struct {
+		name    string
+		joiners int // callers that join the job before the first is cancelled
+	}{
+		{"only caller", 0},
+		{"one of several callers", 3},
+	}
+	for _, tt := range tests {
+		ip := NewImageProcessor(Config{ImageCacheDir: t.TempDir(), ImageMaxConcurrent: 2})
+		cachedPath := filepath.Join(ip.cacheDir, "variant.jpg")
+		release := make(chan struct{})
+		var runs atomic.Int32
+		work := func() error {
+			runs.Add(1)
+			<-release
+			return os.WriteFile(cachedPath, []byte("x"), 0644)
+		}
+
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() {
+			_, err := ip.generate(ctx, cachedPath, "fallback", work)
+			errc <- err
+		}()
+		for range tt.joiners {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if path, err := ip.generate(context.Background(), cachedPath, "fallback", work); err != nil || path != cachedPath {
+					t.Errorf("%s: joiner got %q, %v", tt.name, path, err)
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-errc:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: cancelled caller got %v, want %v", tt.name, err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: cancelled caller is still waiting", tt.name)
+		}
+
+		close(release)
+		wg.Wait()
+		ip.Wait(context.Background())
+		if _, err := os.Stat(cachedPath); err != nil {
+			t.Errorf("%s: resize was not cached after the cancel: %v", tt.name, err)
+		}
+		if path, err := ip.generate(context.Background(), cachedPath, "fallback", work); err != nil || path != cachedPath {
+			t.Errorf("%s: next caller got %q, %v", tt.name, path, err)
+		}
+		if got := runs.Load(); got != 1 {
+			t.Errorf("%s: work ran %d times, want 1", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// imageStats counts ImageProcessor activity. All fields are updated atomically.
+type imageStats struct {
+	hits        atomic.Int64 // requests served from the cache
+	misses      atomic.Int64 // requests that needed a job
+	busy        atomic.Int64 // requests rejected with errTooManyResizes
+	jobs        atomic.Int64 // completed jobs (resizes, thumbnails, blurhashes)
+	jobErrors   atomic.Int64 // jobs that returned an error
+	jobNanos    atomic.Int64 // total time spent in jobs
+	maxJobNanos atomic.Int64 // longest single job
+}
+
+// observeJob records the duration and outcome of one job.
+func (s *imageStats) observeJob(d time.Duration, err error) {
+	s.jobs.Add(1)
+	if err != nil {
+		s.jobErrors.Add(1)
+	}
+	s.jobNanos.Add(int64(d))
+	for {
+		cur := s.maxJobNanos.Load()
+		if int64(d) <= cur || s.maxJobNanos.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// ImageStats is a snapshot of the image processor counters.
+type ImageStats struct {
+	CacheHits          int64   `json:"cache_hits"`
+	CacheMisses        int64   `json:"cache_misses"`
+	BusyResponses      int64   `json:"busy_responses"`
+	Jobs               int64   `json:"jobs"`
+	JobErrors          int64   `json:"job_errors"`
+	JobSecondsTotal    float64 `json:"job_seconds_total"`
+	JobSecondsAvg      float64 `json:"job_seconds_avg"`
+	JobSecondsMax      float64 `json:"job_seconds_max"`
+	ActiveJobs         int     `json:"active_jobs"`
+	MaxConcurrent      int     `json:"max_concurrent"`
+	CacheBytes         int64   `json:"cache_bytes"`
+	CacheFiles         int     `json:"cache_files"`
+	CacheExpirationMin float64 `json:"cache_expiration_minutes"`
+}
+
+// Stats returns a snapshot of the processor counters.
+func (ip *ImageProcessor) Stats() ImageStats {
+	st := ImageStats{
+		CacheHits:          ip.stats.hits.Load(),
+		CacheMisses:        ip.stats.misses.Load(),
+		BusyResponses:      ip.stats.busy.Load(),
+		Jobs:               ip.stats.jobs.Load(),
+		JobErrors:          ip.stats.jobErrors.Load(),
+		JobSecondsTotal:    time.Duration(ip.stats.jobNanos.Load()).Seconds(),
+		JobSecondsMax:      time.Duration(ip.stats.maxJobNanos.Load()).Seconds(),
+		MaxConcurrent:      ip.maxConcurrent,
+		CacheExpirationMin: ip.Expiration().Minutes(),
+	}
+	if st.Jobs > 0 {
+		st.JobSecondsAvg = st.JobSecondsTotal / float64(st.Jobs)
+	}
+
+	ip.jobsMux.RLock()
+	st.ActiveJobs = len(ip.activeJobs)
+	ip.jobsMux.RUnlock()
+
+	ip.cacheMux.Lock()
+	st.CacheBytes = ip.cacheBytes
+	st.CacheFiles = len(ip.cacheIndex)
+	ip.cacheMux.Unlock()
+	return st
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/sha1"
 	"database/sql"
-	"log"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
-	"text/template"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,8 +21,23 @@ type folderJob struct {
 	path string
 }
 
-func InitScanFolders(config Config, db *sql.DB, tmpl *template.Template) {
-	log.Println("Initializing markdown posts by scanning watched folders...")
+// scanProgress counts the folders of the running or last folder scan.
+type scanProgress struct {
+	discovered atomic.Int64 // folders found by the walk
+	scanned    atomic.Int64 // folders checked by a worker
+	updated    atomic.Int64 // folders whose post was written
+}
+
+var scanStats scanProgress
+
+func InitScanFolders(config Config, db *sql.DB, ip *ImageProcessor) {
+	slog.Info("Initializing markdown posts by scanning watched folders")
+	scanStats.discovered.Store(0)
+	scanStats.scanned.Store(0)
+	scanStats.updated.Store(0)
+
+	// The walk and the workers share the parsed ignore rules
+	ignore := newIgnoreMatcher(config)
 
 	// 1. Use a buffered channel for folder discovery
 	folderChan := make(chan string, 1000)
@@ -32,6 +51,10 @@ func InitScanFolders(config Config, db *sql.DB, tmpl *template.Template) {
 				return err
 			}
 			if info.IsDir() && path != config.WatchDir {
+				if ignore.ignored(path, true) {
+					return filepath.SkipDir
+				}
+				scanStats.discovered.Add(1)
 				folderChan <- path
 			}
 			return nil
@@ -48,13 +71,8 @@ func InitScanFolders(config Config, db *sql.DB, tmpl *template.Template) {
 	jobs := make(chan folderJob, numWorkers*2)
 	var wg sync.WaitGroup
 
-	// 3. Add DB transaction support
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
-		return
-	}
-	defer tx.Rollback()
+	// 3. Workers write through shared transactions rather than one per post
+	batch := newPostBatch(db)
 
 	// 4. Worker function with batched DB operations
 	worker := func(id int) {
@@ -64,55 +82,38 @@ func InitScanFolders(config Config, db *sql.DB, tmpl *template.Template) {
 
 		for job := range jobs {
 			start := time.Now()
+			scanStats.scanned.Add(1)
 
 			// Quick check if folder needs processing
 			folderSHA := sha1Hex(job.path)
-			existingPath := GetRelPath(db, folderSHA)
+			existingPath := batch.RelPath(folderSHA)
 
 			// Do single directory read instead of separate scans
 			entries, err := os.ReadDir(job.path)
 			if err != nil {
-				log.Printf("[Worker %d] Error reading directory: %v", id, err)
+				slog.Error("Reading directory failed", "worker", id, "path", job.path, "err", err)
 				continue
 			}
 
-			// Reset slices without allocation
-			images = images[:0]
-			videos = videos[:0]
-
-			// Single pass file counting and classification
-			for _, entry := range entries {
-				if entry.IsDir() {
-					continue
-				}
-				name := entry.Name()
-				ext := strings.ToLower(filepath.Ext(name))
-
-				// Classify files in single pass
-				switch {
-				case isInSlice(ext, config.PhotoExts):
-					images = append(images, name)
-				case isInSlice(ext, config.VideoExts):
-					videos = append(videos, name)
-				}
-			}
+			// Single pass file counting and classification, reusing the
+			// slices without allocation
+			images, videos = classifyMedia(config, ignore, job.path, entries, images[:0], videos[:0])
 
 			totalFiles := len(images) + len(videos)
 
-			if existingPath != "" {
-				nFile := GetNFile(db, folderSHA)
-				if nFile == totalFiles {
-					continue
-				}
+			// Compare file names, not just the count, so renames are picked up
+			if existingPath != "" && batch.ContentHash(folderSHA) == folderHash(config, job.path, entries, images, videos) {
+				continue
 			}
 
-			log.Printf("[Worker %d] Processing: %s (%d files, took %v)",
-				id, job.path, totalFiles, time.Since(start))
+			scanStats.updated.Add(1)
+			slog.Info("Processed folder", "worker", id, "sha", folderSHA, "path", job.path,
+				"files", totalFiles, "took", time.Since(start))
 
 			if existingPath == "" {
-				handleNewFolderWithTemplate(job.path, config, db, tmpl, false, images, videos)
+				handleNewFolderWithTemplate(job.path, config, batch, ip, false, images, videos)
 			} else {
-				updatePost(db, job.path, images, videos, config, tmpl)
+				updatePost(batch, job.path, images, videos, config)
 			}
 		}
 		wg.Done()
@@ -132,16 +133,16 @@ func InitScanFolders(config Config, db *sql.DB, tmpl *template.Template) {
 	// Check for folder discovery errors
 	select {
 	case err := <-errChan:
-		log.Printf("Error during folder scan: %v", err)
+		slog.Error("Folder scan failed", "err", err)
 	default:
 	}
 
 	close(jobs)
 	wg.Wait()
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
+	// Commit the last batch
+	if err := batch.Flush(); err != nil {
+		slog.Error("Committing transaction failed", "err", err)
 	}
 }
 
@@ -154,3 +155,139 @@ func isInSlice(item string, slice []string) bool {
 	}
 	return false
 }
+
+// mediaSizes returns the size in bytes of each named file among a folder's
+// entries, 0 when it cannot be read.
+func mediaSizes(entries []os.DirEntry, names []string) []int64 {
+	byName := make(map[string]os.DirEntry, len(entries))
+	for _, entry := range entries {
+		byName[entry.Name()] = entry
+	}
+	sizes := make([]int64, len(names))
+	for i, name := range names {
+		if entry, ok := byName[name]; ok {
+			if info, err := entry.Info(); err == nil {
+				sizes[i] = info.Size()
+			}
+		}
+	}
+	return sizes
+}
+
+// classifyMedia appends the photo and video names among a folder's entries to
+// images and videos in media_sort order, skipping subfolders and files excluded
+// by ignore.
+func classifyMedia(config Config, ignore *ignoreMatcher, dir string, entries []os.DirEntry, images, videos []string) ([]string, []string) {
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		ext := mediaExt(config, filepath.Join(dir, name))
+
+		switch {
+		case isInSlice(ext, config.PhotoExts):
+		case isInSlice(ext, config.VideoExts):
+		default:
+			continue
+		}
+		if ignore.ignored(filepath.Join(dir, name), false) {
+			continue
+		}
+		if isInSlice(ext, config.PhotoExts) {
+			images = append(images, name)
+		} else {
+			videos = append(videos, name)
+		}
+	}
+	sortMedia(config.MediaSort, entries, images)
+	sortMedia(config.MediaSort, entries, videos)
+	return images, videos
+}
+
+// sniffedExts maps the media types http.DetectContentType recognizes to the
+// extensions they may be listed under.
+var sniffedExts = map[string][]string{
+	"image/jpeg": {".jpg", ".jpeg"},
+	"image/png":  {".png"},
+	"image/gif":  {".gif"},
+	"image/webp": {".webp"},
+	"image/bmp":  {".bmp"},
+	"video/mp4":  {".mp4", ".m4v", ".mov"},
+	"video/webm": {".webm", ".mkv"},
+	"video/avi":  {".avi"},
+}
+
+// mediaExt returns the lower-cased extension path is classified by. With
+// sniff_content_type, a file without an extension gets the one of its
+// sniffed content type that photo_extensions or video_extensions lists.
+func mediaExt(config Config, path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != "" || !config.SniffContentType {
+		return ext
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	for _, ext := range sniffedExts[http.DetectContentType(buf[:n])] {
+		if isInSlice(ext, config.PhotoExts) || isInSlice(ext, config.VideoExts) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// contentHash identifies a folder's media by the names of its files, so a
+// rename changes it even when the count stays the same, and by its
+// description. images and videos must be sorted, as classifyMedia returns
+// them.
+func contentHash(images, videos []string, description string) string {
+	h := sha1.New()
+	for _, name := range images {
+		io.WriteString(h, name+"\n")
+	}
+	io.WriteString(h, "\n")
+	for _, name := range videos {
+		io.WriteString(h, name+"\n")
+	}
+	// Without a description the hash stays that of earlier versions
+	if description != "" {
+		io.WriteString(h, "\n"+description)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sidecar files whose text becomes the description of their folder's post,
+// in order of preference.
+var descriptionFiles = []string{"description.txt", "README.md"}
+
+// Longest description read from a sidecar file.
+const maxDescriptionBytes = 64 << 10
+
+// readDescription returns the trimmed text of the first sidecar file of dir,
+// or "" when it has none.
+func readDescription(dir string) string {
+	for _, name := range descriptionFiles {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxDescriptionBytes))
+		f.Close()
+		if err != nil {
+			slog.Warn("Reading description failed", "path", filepath.Join(dir, name), "err", err)
+			continue
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// isDescriptionFile reports whether path is a description sidecar file.
+func isDescriptionFile(path string) bool {
+	return isInSlice(filepath.Base(path), descriptionFiles)
+}
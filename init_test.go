@@ -0,0 +1,115 @@
+package main
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInitScanRegeneratesRenamedFiles(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 8, 8, color.White)
+	dir := filepath.Join(g.config.WatchDir, "Trip")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), jpg, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha := sha1Hex(dir)
+	postPath := postFilePath(g.config, "Trip", sha)
+
+	tests := []struct {
+		name        string
+		rename      [2]string // file renamed before the scan, if any
+		wantInPost  string
+		wantChanged bool
+	}{
+		{"first scan", [2]string{}, "b.jpg", true},
+		{"unchanged", [2]string{}, "b.jpg", false},
+		{"renamed", [2]string{"b.jpg", "c.jpg"}, "c.jpg", true},
+	}
+	oldHash := ""
+	for _, tt := range tests {
+		if tt.rename[0] != "" {
+			if err := os.Rename(filepath.Join(dir, tt.rename[0]), filepath.Join(dir, tt.rename[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		InitScanFolders(g.config, g.db, nil)
+
+		md, err := os.ReadFile(postPath)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.Contains(string(md), tt.wantInPost) {
+			t.Errorf("%s: post does not mention %s", tt.name, tt.wantInPost)
+		}
+		if tt.rename[0] != "" && strings.Contains(string(md), tt.rename[0]) {
+			t.Errorf("%s: post still mentions %s", tt.name, tt.rename[0])
+		}
+		hash := GetContentHash(g.db, sha)
+		if changed := hash != oldHash; changed != tt.wantChanged {
+			t.Errorf("%s: content hash changed = %v, want %v", tt.name, changed, tt.wantChanged)
+		}
+		wantUpdated := int64(0)
+		if tt.wantChanged {
+			wantUpdated = 1
+		}
+		if got := scanStats.updated.Load(); got != wantUpdated {
+			t.Errorf("%s: %d folders updated, want %d", tt.name, got, wantUpdated)
+		}
+		oldHash = hash
+	}
+}
+
+func TestClassifyMediaExtensions(t *testing.T) {
+	dir := t.TempDir()
+	jpg := testJPEG(t, 8, 8, color.White)
+	files := map[string][]byte{
+		"a.jpg": jpg, "b.JPG": jpg, "c.Jpeg": jpg, "d.png": nil,
+		"e.MP4": nil, "f.mov": nil, "g.txt": nil, "noext": jpg,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		photoExts  []string
+		videoExts  []string
+		sniff      bool
+		wantImages []string
+		wantVideos []string
+	}{
+		{"dotless", []string{"jpg", "jpeg"}, []string{"mp4"}, false,
+			[]string{"a.jpg", "b.JPG", "c.Jpeg"}, []string{"e.MP4"}},
+		{"mixed case", []string{".JPG", "JPEG", ".Png"}, []string{".MOV", "Mp4"}, false,
+			[]string{"a.jpg", "b.JPG", "c.Jpeg", "d.png"}, []string{"e.MP4", "f.mov"}},
+		{"file without extension, sniffed", []string{"JPG"}, nil, true,
+			[]string{"a.jpg", "b.JPG", "noext"}, nil},
+	}
+	for _, tt := range tests {
+		config := Config{
+			PhotoExts:        normalizeExts(tt.photoExts),
+			VideoExts:        normalizeExts(tt.videoExts),
+			SniffContentType: tt.sniff,
+			MediaSort:        "name_natural",
+		}
+		images, videos := classifyMedia(config, newIgnoreMatcher(config), dir, entries, nil, nil)
+		if !reflect.DeepEqual(images, tt.wantImages) || !reflect.DeepEqual(videos, tt.wantVideos) {
+			t.Errorf("%s: classifyMedia = %q, %q, want %q, %q", tt.name, images, videos, tt.wantImages, tt.wantVideos)
+		}
+	}
+}
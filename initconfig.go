@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configKeyDoc describes one config.ini key for --init-config.
+type configKeyDoc struct {
+	key   string
+	value string // default value written to the file
+	doc   string // comment lines written above the key
+}
+
+// configKeyDocs lists every [main] key, grouped as in the README.
+var configKeyDocs = []configKeyDoc{
+	{"watched_folder", "/path/to/photos", "Folder of photo/video folders to watch; each folder becomes a post. Required."},
+	{"image_root", "", "Folder the originals are served from, with the same layout as watched_folder.\nEmpty uses watched_folder."},
+	{"photo_extensions", ".jpg,.jpeg,.png", "Photo file extensions, case-insensitive."},
+	{"video_extensions", ".mp4,.mov", "Video file extensions, case-insensitive."},
+	{"sniff_content_type", "false", "Classify files without an extension by their first 512 bytes."},
+	{"media_sort", "name_natural", "Order of files in a post: name, name_natural, mtime_asc or mtime_desc."},
+	{"max_files_per_post", "0", "Most photos and videos listed in a post, photos first; 0 for no limit."},
+	{"enable_albums", "false", "Give folders holding only subfolders an album page linking the galleries below."},
+	{"ignore_patterns", strings.Join(defaultIgnorePatterns, ","), "Names of files and folders skipped everywhere (glob patterns)."},
+	{"date_from_exif", "false", "Date posts by the earliest EXIF capture date instead of the folder mtime."},
+	{"watch_mode", "fsnotify", "fsnotify, poll, or auto to poll when watching fails."},
+	{"poll_interval_seconds", "60", "Seconds between rescans when polling."},
+
+	{"hugo_bin_path", "hugo", "Path to the Hugo binary. Required."},
+	{"hugo_built_out_folder", "./public", "Folder Hugo writes the site to. Required."},
+	{"hugo_content_dir", "content", "Hugo content directory."},
+	{"post_layout", "post", "Where posts are written: post for all in hugo_content_dir/post, category for one folder per category."},
+	{"hugo_archetype", "./archetypes/photo.md", "Template of the generated posts. Required."},
+	{"category_archetypes", "", "Archetype per top-level category as category=path pairs, e.g. cosplay=./archetypes/cosplay.md."},
+	{"hugo_config", "", "Hugo site config file; empty detects hugo.toml, config.toml, ... in the site root."},
+	{"hugo_args", "", "Extra arguments appended to every hugo command, e.g. --minify,--gc,--baseURL=https://example.com/."},
+	{"hugo_env", "", "KEY=VALUE variables added to Hugo's environment."},
+	{"hugo_partial_rebuild", "false", "Render only the pages a change touches (Hugo 0.124+)."},
+	{"idle_second", "5", "Seconds without changes before Hugo rebuilds."},
+	{"rebuild_min_interval", "0", "Minimum seconds between full Hugo builds, 0 for no minimum."},
+
+	{"sqlite_db_path", "./posts.db", "SQLite database file. Required."},
+	{"db_maintenance_hours", "24", "Hours between SQLite integrity checks and VACUUM, 0 to disable."},
+
+	{"tag_language", "zh", "Tokenizer for folder names: zh, ja, en or auto."},
+	{"enable_jieba", "true", "Tag posts with the words Jieba cuts from the folder name."},
+	{"jieba_user_words", strings.Join(defaultJiebaUserWords, ","), "Words Jieba must not split."},
+	{"jieba_user_dict", "", "Jieba user dictionary file."},
+	{"tag_skip_words", strings.Join(defaultTagSkipWords, ","), "Words never used as tags."},
+	{"tag_skip_words_file", "", "File with more skip words, one per line."},
+	{"max_tags", "0", "Most tags per post, 0 for no limit."},
+
+	{"image_cache_folder", "./cache", "Folder of resized images, thumbnails and blurhashes. Required."},
+	{"image_cache_expiration_minutes", "10080", "Minutes before unused cache files are removed."},
+	{"cache_cleanup_interval_minutes", "10080", "Minutes between removals of expired cache files (weekly); one also runs at\nstartup."},
+	{"max_cache_bytes", "0", "Evict least recently used cache files above this size, 0 for no limit."},
+	{"image_cache_sharding", "true", "Spread cache files over subdirectories by hash prefix."},
+	{"image_cache_key_source", "true", "Name cached variants after the source's size and mtime too, so replacing\na photo regenerates them."},
+	{"image_open_retries", "2", "Retries of a photo that failed to read, waiting 100ms, then 200ms, and so on."},
+	{"output_format", "", "Format of resized images: jpeg, png, webp or avif. Empty keeps the source format."},
+	{"jpeg_quality", "85", "JPEG quality (1-100) of resized images."},
+	{"negotiate_webp", "true", "Serve resized images as WebP when the Accept header allows."},
+	{"image_cache_control_seconds", "31536000", "Cache-Control max-age of resized images (originals, and all images without\nimage_cache_key_source, get at most an hour), 0 to send none."},
+	{"strip_metadata", "false", "Never serve photos with EXIF/IPTC/XMP metadata."},
+	{"corrupt_image_placeholder", "", "Image served for photos that cannot be decoded; empty serves a gray box\nof the requested size."},
+	{"allow_upscale", "false", "Enlarge images when the requested size exceeds the source."},
+	{"resize_filter", "lanczos", "Resampling filter: lanczos, catmullrom, linear or box."},
+	{"image_max_concurrent", "", "Maximum number of concurrent image jobs; empty uses the number of CPUs."},
+	{"allowed_widths", "", "Widths requests are snapped to, e.g. 300,600,1200. Empty allows any width."},
+	{"precompute_widths", "", "Thumbnail widths generated in the background for new folders."},
+	{"warm_cache_manifest", "", "File of \"path width\" lines pregenerated at startup."},
+	{"ffmpeg_bin_path", "ffmpeg", "ffmpeg binary used for video thumbnails."},
+
+	{"http_port", "8080", "Port of the HTTP server."},
+	{"bind_address", "", "IP or host name to listen on, e.g. 127.0.0.1; empty for all interfaces."},
+	{"enable_gzip", "true", "Compress text responses of the Hugo site."},
+	{"http_read_timeout_seconds", "30", "Seconds to read a request, 0 for no limit."},
+	{"http_write_timeout_seconds", "120", "Seconds to write a response, 0 for no limit. Videos and folder downloads are exempt."},
+	{"http_idle_timeout_seconds", "120", "Seconds an idle keep-alive connection stays open, 0 for no limit."},
+	{"tls_cert", "", "Certificate file; HTTPS is served when set together with tls_key."},
+	{"tls_key", "", "Private key file of tls_cert."},
+	{"http_redirect_port", "", "Port redirecting plain HTTP to HTTPS, empty to disable."},
+	{"auth_user", "", "Basic auth user name, empty to disable auth."},
+	{"auth_pass", "", "Basic auth password in plain text."},
+	{"auth_pass_bcrypt", "", "Basic auth password as a bcrypt hash, preferred over auth_pass."},
+	{"image_rate_per_sec", "0", "Image requests per second allowed per client IP, 0 to disable."},
+	{"image_rate_burst", "", "Image requests a client may make at once; empty rounds up image_rate_per_sec."},
+	{"trusted_proxy", "", "Proxy IPs/CIDRs whose X-Forwarded-For is trusted."},
+
+	{"feed_size", "20", "Newest posts listed in /feed.xml."},
+	{"feed_format", "rss", "rss or atom."},
+	{"feed_title", "New galleries", "Title of /feed.xml."},
+
+	{"enable_metrics", "false", "Serve Prometheus metrics at /metrics."},
+	{"metrics_port", "", "Separate port for /metrics, empty to serve it on http_port."},
+	{"verbose", "false", "Verbose logging."},
+	{"log_level", "", "debug, info, warn or error; empty is debug when verbose is set, else info."},
+	{"log_format", "text", "text or json."},
+}
+
+// writeDefaultConfig writes a commented config.ini with every key and its
+// default to path. An existing file is never overwritten.
+func writeDefaultConfig(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "; Generated by --init-config. Keys left empty use the default described above them.")
+	fmt.Fprintln(w, "; Any key can also be set with a GALLERY_<KEY> environment variable.")
+	fmt.Fprintln(w, "[main]")
+	for _, k := range configKeyDocs {
+		fmt.Fprintln(w)
+		for _, line := range strings.Split(k.doc, "\n") {
+			fmt.Fprintln(w, "; "+line)
+		}
+		value := k.value
+		// '#' and ';' start a comment unless the value is quoted
+		if strings.ContainsAny(value, "#;") {
+			value = "`" + value + "`"
+		}
+		fmt.Fprintln(w, strings.TrimSpace(k.key+" = "+value))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is shared by the installed handler so reloads can change it.
+var logLevel slog.LevelVar
+
+// parseLogLevel parses a log_level value: debug, info, warn or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// configLogLevel returns log_level, or debug when only verbose is set.
+func configLogLevel(config Config) slog.Level {
+	if level, err := parseLogLevel(config.LogLevel); err == nil {
+		return level
+	}
+	if config.Verbose {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// setupLogging installs the default slog logger, writing text or JSON
+// records to stderr. Calls through the log package go through it as well.
+func setupLogging(config Config) {
+	logLevel.Set(configLogLevel(config))
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if config.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
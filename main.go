@@ -1,30 +1,128 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
 )
 
-var folderMap = make(map[string]string)
+// Default path of the config file, re-read on SIGHUP.
+const defaultConfigPath = "config.ini"
 
-func loadTemplate(templatePath string) *template.Template {
-	t, err := template.New(filepath.Base(templatePath)).Funcs(template.FuncMap{
-		"urlquery": template.URLQueryEscaper,
-		"now":      func() string { return time.Now().Format("2006-01-02T15:04:05Z07:00") },
-	}).ParseFiles(templatePath)
+// configFlags are the command-line flags overriding config.ini keys.
+var configFlags = []struct {
+	name, key, usage string
+}{
+	{"port", "http_port", "HTTP port"},
+	{"watch", "watched_folder", "folder to watch"},
+	{"hugo-out", "hugo_built_out_folder", "folder Hugo builds the site into"},
+	{"verbose", "verbose", "verbose logging"},
+}
+
+// ready is set once the initial scan and Hugo build have finished.
+var ready atomic.Bool
+
+// loadTemplate parses hugo_archetype and the category_archetypes into one
+// template set.
+func loadTemplate(config Config) (*template.Template, error) {
+	t, err := template.New(filepath.Base(config.Archetype)).Funcs(template.FuncMap{
+		"urlquery":  template.URLQueryEscaper,
+		"now":       func() string { return time.Now().Format("2006-01-02T15:04:05Z07:00") },
+		"humanSize": humanSize,
+		"slugify":   slugify,
+		"truncate":  truncate,
+		"thumbURL":  thumbURL,
+	}).ParseFiles(config.Archetype)
 	if err != nil {
-		log.Fatalf("Error loading template: %v", err)
+		return nil, err
 	}
-	return t
+	// Category archetypes join the set under their own names
+	for category, path := range config.CategoryArchetypes {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			_, err = t.New(categoryTemplateName(category)).Parse(string(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %w", category, err)
+		}
+	}
+	return t, nil
+}
+
+// categoryTemplateName names the archetype of a top-level category in the
+// template set.
+func categoryTemplateName(category string) string {
+	return "category:" + category
 }
 
 func main() {
-	config := LoadConfig("config.ini")
+	dryRun := flag.Bool("dry-run", false, "log the posts the folder scan would create, update or remove, then exit without writing anything")
+	reindex := flag.Bool("reindex", false, "rebuild the database from the front matter of the markdown posts, then exit")
+	initConfig := flag.Bool("init-config", false, "write a commented config file with every key and its default, then exit")
+	configFile := flag.String("config", defaultConfigPath, "path of the config file")
+	for _, f := range configFlags {
+		usage := f.usage + ", overriding " + f.key
+		if f.key == "verbose" {
+			flag.Bool(f.name, false, usage)
+		} else {
+			flag.String(f.name, "", usage)
+		}
+	}
+	flag.Parse()
+	configPath := *configFile
+	// Only flags given on the command line override the config
+	flag.Visit(func(set *flag.Flag) {
+		for _, f := range configFlags {
+			if f.name == set.Name {
+				flagOverrides[f.key] = set.Value.String()
+			}
+		}
+	})
+
+	if *initConfig {
+		if err := writeDefaultConfig(configPath); err != nil {
+			log.Fatalf("Writing %s failed: %v", configPath, err)
+		}
+		fmt.Printf("Wrote %s; set watched_folder and the other required keys before starting.\n", configPath)
+		return
+	}
+
+	checkHugoBinary = !*dryRun && !*reindex
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration in %s:\n%v", configPath, err)
+	}
+	liveConfig.Store(&config)
+	setupLogging(config)
+	onConfigReload(func(c Config) {
+		logLevel.Set(configLogLevel(c))
+	})
+
+	if *dryRun {
+		DryRunScan(config)
+		cleanupJieba()
+		return
+	}
+
+	if *reindex {
+		db := InitDB(config.SqlitePath)
+		n, err := Reindex(config, db)
+		db.Close()
+		if err != nil {
+			log.Fatalf("Reindexing failed after %d posts: %v", n, err)
+		}
+		slog.Info("Rebuilt database from markdown posts", "posts", n, "path", config.SqlitePath)
+		return
+	}
 
 	// Check if database needs initialization
 	dbNeedsInit := true
@@ -33,41 +131,90 @@ func main() {
 	}
 
 	db := InitDB(config.SqlitePath)
-	defer db.Close()
 
-	// Load template only once
-	tmpl := loadTemplate(config.Archetype)
+	// Load template; it is reloaded when the archetype files change
+	tmpl, err := loadTemplate(config)
+	if err != nil {
+		log.Fatalf("Error loading template: %v", err)
+	}
+	liveTemplate.Store(tmpl)
+
+	// Create image processor
+	imageProcessor := NewImageProcessor(config)
+	onConfigReload(func(c Config) {
+		imageProcessor.SetExpiration(time.Duration(c.ImageCacheExpirationMinutes) * time.Minute)
+	})
+
+	rescanner := NewRescanner(config, db, imageProcessor)
+
+	// Apply the hot-reloadable config keys on SIGHUP. Registered before the
+	// initial scan, which can take long, since SIGHUP otherwise terminates
+	// the process.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("Received SIGHUP, reloading config", "path", configPath)
+			reloadConfig(configPath)
+		}
+	}()
+
+	// Start the server first so /healthz reports 503 during the initial scan
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		if err := ServeHugo(ctx, config, imageProcessor, db, rescanner); err != nil {
+			slog.Error("HTTP server failed", "err", err)
+		}
+	}()
 
 	// Initialization: scan folders and generate posts if DB is new
 	if dbNeedsInit {
-		log.Println("SQLite DB does not exist. Running initial scan of folders to create markdowns and DB records.")
-		InitScanFolders(config, db, tmpl)
+		slog.Info("Running initial scan of folders to create markdowns and DB records")
+		rescanner.Run()
+	} else {
+		houseKeeping(config, db)
+	}
+	if n, err := CountPosts(db); err == nil {
+		slog.Info("Posts in SQLite", "folders", n)
 	}
-	houseKeeping(config, db)
-
-	// Rebuild map from SQLite for image serving
-	folderMap = LoadFolderMap(db)
-	log.Printf("Loaded %d folder mappings from SQLite", len(folderMap))
 
 	// Build Hugo site after markdowns are ready
-	rebuildHugo(config)
-
-	// Create image processor
-	imageProcessor := NewImageProcessor(config.ImageCacheDir, config.ImageRoot, time.Duration(config.ImageCacheExpirationMinutes)*time.Minute, 10)
+	rebuildHugoNow(config)
+	ready.Store(true)
 
-	// Initialize and start server and folder watcher
-	go ServeHugo(config, imageProcessor, db)
-	go WatchFolders(config, db, tmpl)
+	// Start folder watcher
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		watchFolders(ctx, config, db, imageProcessor, rescanner)
+	}()
 
 	// Start image cache cleanup routine
-	imageProcessor.StartCleanupRoutine(time.Hour * 7 * 24)
+	imageProcessor.StartCleanupRoutine(time.Duration(config.CacheCleanupIntervalMinutes) * time.Minute)
 	startHouseKeeping(config, db, time.Minute*30)
+	startDBMaintenance(config, db)
+	go watchTemplates(ctx, config, db)
+	if config.WarmCacheManifest != "" {
+		go imageProcessor.WarmCache(ctx, config.WarmCacheManifest)
+	}
 
-	// Defer cleanup
-	defer cleanupJieba()
+	<-ctx.Done()
+	slog.Info("Shutting down")
+	<-serverDone
+	<-watcherDone
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
-	log.Println("Shutting down...")
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := imageProcessor.Wait(drainCtx); err != nil {
+		slog.Error("Waiting for image jobs failed", "err", err)
+	}
+	stopHugoBuilds()
+	cleanupJieba()
+	if err := db.Close(); err != nil {
+		slog.Error("Closing database failed", "err", err)
+	}
+	slog.Info("Shutdown complete")
 }
@@ -2,8 +2,9 @@ package main
 
 import (
     "bytes"
+    "fmt"
     "text/template"
-    "log"
+    "log/slog"
     "path/filepath"
     "time"
     "net/url"
@@ -12,15 +13,26 @@ import (
 type MarkdownData struct {
     FolderName string
     FolderSHA  string
+    RelPath string // folder path relative to the watched folder, read back by --reindex
+    FolderCover string
     ImagesURL  []string
     Images     []string
+    ImageSizes []int64 // bytes, parallel to Images
     VideosURL  []string
     Videos     []string
+    VideoSizes []int64 // bytes, parallel to Videos
     Tags []string
     Date string
+    Description string // text of the folder's description.txt or README.md
+    TotalFiles int // media files in the folder, more than listed when Capped
+    Capped bool // the media lists were cut to max_files_per_post
+    IsAlbum bool // a folder without media linking to the galleries below it
+    Children []AlbumChild // galleries of an album
 }
 
-func generateMarkdownWithTemplate(tmpl *template.Template, images []string, videos []string, folderName, folderSHA string, tags []string, date time.Time) string {
+// generateMarkdownWithTemplate renders a post with the archetype of its
+// top-level category, or the default one when the category has none.
+func generateMarkdownWithTemplate(tmpl *template.Template, category string, images []string, videos []string, imageSizes, videoSizes []int64, folderName, relPath, folderSHA, cover string, tags []string, date time.Time, description string, totalFiles int) string {
   encodedVideos := make([]string, len(videos))
   encodedImages := make([]string, len(images))
   for i, v := range videos {
@@ -32,18 +44,62 @@ func generateMarkdownWithTemplate(tmpl *template.Template, images []string, vide
 	data := MarkdownData{
     FolderName: folderName,
     FolderSHA:  folderSHA,
+    RelPath: relPath,
+    FolderCover: cover,
     ImagesURL:     encodedImages,
     Images: images,
+    ImageSizes: imageSizes,
     VideosURL:     encodedVideos,
     Videos: videos,
+    VideoSizes: videoSizes,
     Tags: tags,
     Date: date.Format("2006-01-02T15:04:05-07:00"),
+    Description: description,
+    TotalFiles: totalFiles,
+    Capped: totalFiles > len(images)+len(videos),
 	}
+	return renderMarkdown(tmpl, category, data)
+}
+
+// generateAlbumMarkdown renders the album page of a folder without media.
+func generateAlbumMarkdown(tmpl *template.Template, category, folderName, relPath, folderSHA string, tags []string, date time.Time, description string, children []AlbumChild) string {
+	data := MarkdownData{
+    FolderName: folderName,
+    FolderSHA:  folderSHA,
+    RelPath: relPath,
+    Tags: tags,
+    Date: date.Format("2006-01-02T15:04:05-07:00"),
+    Description: description,
+    IsAlbum: true,
+    Children: children,
+	}
+	return renderMarkdown(tmpl, category, data)
+}
+
+func renderMarkdown(tmpl *template.Template, category string, data MarkdownData) string {
 	var buf bytes.Buffer
-	err := tmpl.ExecuteTemplate(&buf, filepath.Base(tmpl.Name()), data)
+	name := filepath.Base(tmpl.Name())
+	if t := tmpl.Lookup(categoryTemplateName(category)); t != nil {
+		name = t.Name()
+	}
+	err := tmpl.ExecuteTemplate(&buf, name, data)
 	if err != nil {
-		log.Printf("Error executing template: %v", err)
+		slog.Error("Executing template failed", "err", err)
 		return ""
 	}
 	return buf.String()
 }
+
+// humanSize formats a byte count for templates, e.g. "1.5 MB".
+func humanSize(n int64) string {
+  const unit = 1024
+  if n < unit {
+    return fmt.Sprintf("%d B", n)
+  }
+  div, exp := int64(unit), 0
+  for m := n / unit; m >= unit; m /= unit {
+    div *= unit
+    exp++
+  }
+  return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
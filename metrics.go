@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serviceMetrics counts service activity for /metrics. All fields are updated
+// atomically.
+type serviceMetrics struct {
+	started              time.Time    // process start
+	builds               atomic.Int64 // Hugo builds run
+	buildFailures        atomic.Int64 // Hugo builds that exited with an error
+	lastBuildFailed      atomic.Bool  // whether the last Hugo build exited with an error
+	lastBuildNanos       atomic.Int64 // duration of the last Hugo build
+	lastBuildUnix        atomic.Int64 // end of the last Hugo build
+	watcherEvents        atomic.Int64 // fsnotify events processed
+	watching             atomic.Bool  // the fsnotify watcher is running
+	polling              atomic.Bool  // WatchDir is rescanned every poll_interval_seconds
+	watchedFolders       atomic.Int64 // folders with an fsnotify watch
+	polledFolders        atomic.Int64 // folders past the inotify limit, rescanned instead
+	housekeepingRuns     atomic.Int64 // houseKeeping passes
+	lastHousekeepingUnix atomic.Int64 // end of the last houseKeeping pass
+}
+
+var metrics = serviceMetrics{started: time.Now()}
+
+// queryStats sums the latency of one kind of database query.
+type queryStats struct {
+	count int64
+	nanos int64
+}
+
+var (
+	dbQueries  = make(map[string]*queryStats) // by query name
+	dbQueryMux sync.Mutex
+)
+
+// observeBuild records a finished Hugo build.
+func (m *serviceMetrics) observeBuild(d time.Duration, err error) {
+	m.builds.Add(1)
+	if err != nil {
+		m.buildFailures.Add(1)
+	}
+	m.lastBuildFailed.Store(err != nil)
+	m.lastBuildNanos.Store(int64(d))
+	m.lastBuildUnix.Store(time.Now().Unix())
+}
+
+// observeQuery records the latency of a query started at start. DB helpers
+// defer it first thing, so the time spent waiting for dbMutex is included.
+func observeQuery(name string, start time.Time) {
+	d := time.Since(start)
+	dbQueryMux.Lock()
+	defer dbQueryMux.Unlock()
+	q := dbQueries[name]
+	if q == nil {
+		q = &queryStats{}
+		dbQueries[name] = q
+	}
+	q.count++
+	q.nanos += int64(d)
+}
+
+// handleMetrics serves the service and image processor counters in the
+// Prometheus text format.
+func handleMetrics(db *sql.DB, ip *ImageProcessor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, db, ip)
+	})
+}
+
+func writeMetrics(w io.Writer, db *sql.DB, ip *ImageProcessor) {
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	}
+
+	if posts, err := CountPosts(db); err == nil {
+		metric("gallery_posts", "gauge", "Posts in the database.", float64(posts))
+	}
+	metric("gallery_hugo_builds_total", "counter", "Hugo builds run.", float64(metrics.builds.Load()))
+	metric("gallery_hugo_build_failures_total", "counter", "Hugo builds that failed.", float64(metrics.buildFailures.Load()))
+	metric("gallery_hugo_last_build_duration_seconds", "gauge", "Duration of the last Hugo build.",
+		time.Duration(metrics.lastBuildNanos.Load()).Seconds())
+	metric("gallery_hugo_last_build_timestamp_seconds", "gauge", "Unix time the last Hugo build finished.",
+		float64(metrics.lastBuildUnix.Load()))
+	metric("gallery_watcher_events_total", "counter", "File system events processed by the watcher.",
+		float64(metrics.watcherEvents.Load()))
+	metric("gallery_watched_folders", "gauge", "Folders watched for changes.", float64(metrics.watchedFolders.Load()))
+	metric("gallery_polled_folders", "gauge", "Folders past the inotify watch limit, rescanned instead.", float64(metrics.polledFolders.Load()))
+	metric("gallery_housekeeping_runs_total", "counter", "Housekeeping passes run.", float64(metrics.housekeepingRuns.Load()))
+	metric("gallery_housekeeping_last_run_timestamp_seconds", "gauge", "Unix time the last housekeeping pass finished.",
+		float64(metrics.lastHousekeepingUnix.Load()))
+
+	st := ip.Stats()
+	metric("gallery_image_cache_hits_total", "counter", "Image requests served from the cache.", float64(st.CacheHits))
+	metric("gallery_image_cache_misses_total", "counter", "Image requests that needed a job.", float64(st.CacheMisses))
+	metric("gallery_image_busy_responses_total", "counter", "Image requests rejected as busy.", float64(st.BusyResponses))
+	metric("gallery_image_jobs_total", "counter", "Image jobs completed.", float64(st.Jobs))
+	metric("gallery_image_job_errors_total", "counter", "Image jobs that failed.", float64(st.JobErrors))
+	metric("gallery_image_job_seconds_total", "counter", "Time spent in image jobs.", st.JobSecondsTotal)
+	metric("gallery_image_active_jobs", "gauge", "Image jobs running now.", float64(st.ActiveJobs))
+	metric("gallery_image_cache_bytes", "gauge", "Size of the image cache.", float64(st.CacheBytes))
+	metric("gallery_image_cache_files", "gauge", "Files in the image cache.", float64(st.CacheFiles))
+
+	dbQueryMux.Lock()
+	names := make([]string, 0, len(dbQueries))
+	for name := range dbQueries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "# HELP gallery_db_query_duration_seconds Latency of database queries.\n# TYPE gallery_db_query_duration_seconds summary\n")
+	for _, name := range names {
+		q := dbQueries[name]
+		fmt.Fprintf(w, "gallery_db_query_duration_seconds_sum{query=%q} %g\n", name, time.Duration(q.nanos).Seconds())
+		fmt.Fprintf(w, "gallery_db_query_duration_seconds_count{query=%q} %d\n", name, q.count)
+	}
+	dbQueryMux.Unlock()
+}
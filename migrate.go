@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// migration is one schema change. Migrations run in order inside a
+// transaction and must be idempotent, since databases created before
+// versioning start at version 0 whatever their actual schema.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change; append new ones with the next version.
+var migrations = []migration{
+	{1, "create posts table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS posts (
+			folder_sha TEXT PRIMARY KEY,
+			post_filename TEXT,
+			tags TEXT,
+			rel_path TEXT,
+			created_at TEXT,
+			n_file INTEGER
+		)`)
+		return err
+	}},
+	{2, "add category and cover columns", func(tx *sql.Tx) error {
+		// Older databases stored the categories in tags; move them and reset
+		// n_file so the next scan rewrites every row with its tags and cover
+		hasCategory, err := hasColumn(tx, "posts", "category")
+		if err != nil {
+			return err
+		}
+		if !hasCategory {
+			if err := addColumn(tx, "posts", "category", "TEXT"); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE posts SET category = tags, tags = '', n_file = -1"); err != nil {
+				return err
+			}
+		}
+		return addColumn(tx, "posts", "cover", "TEXT")
+	}},
+	{3, "add content_hash column", func(tx *sql.Tx) error {
+		return addColumn(tx, "posts", "content_hash", "TEXT")
+	}},
+	{4, "add parent_sha column", func(tx *sql.Tx) error {
+		// Clearing content_hash makes the next scan rewrite every row with
+		// its parent
+		hasParent, err := hasColumn(tx, "posts", "parent_sha")
+		if err != nil || hasParent {
+			return err
+		}
+		if err := addColumn(tx, "posts", "parent_sha", "TEXT"); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE posts SET content_hash = ''")
+		return err
+	}},
+	{5, "add post_tags table", func(tx *sql.Tx) error {
+		// One row per tag of a post, so tags can be counted and matched
+		// without splitting the tags column
+		if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS post_tags (
+			folder_sha TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (folder_sha, tag)
+		)`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS post_tags_tag ON post_tags (tag)"); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT folder_sha, COALESCE(tags, '') FROM posts")
+		if err != nil {
+			return err
+		}
+		tags := make(map[string][]string)
+		for rows.Next() {
+			var sha, joined string
+			if err := rows.Scan(&sha, &joined); err != nil {
+				rows.Close()
+				return err
+			}
+			if joined != "" {
+				tags[sha] = strings.Split(joined, ",")
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for sha, postTags := range tags {
+			if err := setPostTags(tx, sha, postTags); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{6, "add posts_fts search index", func(tx *sql.Tx) error {
+		// Builds without the sqlite_fts5 tag cannot create the index and
+		// fall back to LIKE queries
+		_, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(folder_sha UNINDEXED, name, category, tags)`)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				slog.Warn("Not creating search index, SQLite lacks FTS5 (build with -tags sqlite_fts5)")
+				return nil
+			}
+			return err
+		}
+		return fillSearchIndex(tx)
+	}},
+}
+
+// migrateDB brings the schema to the latest version, tracked in SQLite's
+// user_version pragma.
+func migrateDB(db *sql.DB) error {
+	var current int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("Applied schema migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// fillSearchIndex replaces the contents of posts_fts with an entry for every
+// post.
+func fillSearchIndex(tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM posts_fts"); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT folder_sha, rel_path, COALESCE(category, ''), COALESCE(tags, '') FROM posts")
+	if err != nil {
+		return err
+	}
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		var tags string
+		if err := rows.Scan(&p.FolderSHA, &p.RelPath, &p.Category, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		if tags != "" {
+			p.Tags = strings.Split(tags, ",")
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range posts {
+		if err := replaceSearchEntry(tx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumn adds a column unless it already exists.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openLegacyDB returns a database with the posts table of an unversioned
+// install, whose tags column held the categories.
+func openLegacyDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "posts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`
+		CREATE TABLE posts (
+			folder_sha TEXT PRIMARY KEY,
+			post_filename TEXT,
+			tags TEXT,
+			rel_path TEXT,
+			created_at TEXT,
+			n_file INTEGER
+		)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func postTags(t *testing.T, db *sql.DB, folderSHA string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT tag FROM post_tags WHERE folder_sha = ? ORDER BY tag", folderSHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func TestMigrateMovesLegacyTagsToCategory(t *testing.T) {
+	db := openLegacyDB(t)
+	if _, err := db.Exec("INSERT INTO posts VALUES ('sha', 'sha.md', 'Travel/Japan', 'Travel/Japan/Kyoto', '', 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	var category, tags string
+	if err := db.QueryRow("SELECT category, tags FROM posts WHERE folder_sha = 'sha'").Scan(&category, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if category != "Travel/Japan" || tags != "" {
+		t.Errorf("category, tags = %q, %q, want %q, %q", category, tags, "Travel/Japan", "")
+	}
+	if got := postTags(t, db, "sha"); len(got) != 0 {
+		t.Errorf("post_tags = %q, want none: categories are not tags", got)
+	}
+}
+
+func TestMigrateCopiesTagsToPostTags(t *testing.T) {
+	db := openLegacyDB(t)
+	// Run migrations 1 to 4 only, as on an install from before post_tags
+	all := migrations
+	migrations = all[:4]
+	err := migrateDB(db)
+	migrations = all
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO posts (folder_sha, post_filename, category, tags, rel_path, n_file) VALUES ('sha', 'sha.md', 'Travel/Japan', 'kyoto,temple', 'Travel/Japan/Kyoto temple', 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := postTags(t, db, "sha"), []string{"kyoto", "temple"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("post_tags = %q, want %q", got, want)
+	}
+	var category string
+	if err := db.QueryRow("SELECT category FROM posts WHERE folder_sha = 'sha'").Scan(&category); err != nil {
+		t.Fatal(err)
+	}
+	if category != "Travel/Japan" {
+		t.Errorf("category = %q, want %q", category, "Travel/Japan")
+	}
+}
+
+func TestPostsKeepCategoriesAndTagsApart(t *testing.T) {
+	g := newTestGallery(t)
+	p := Post{
+		FolderSHA: "sha",
+		PostFile:  "sha.md",
+		Category:  "Travel/Japan",
+		Tags:      []string{"kyoto", "temple"},
+		RelPath:   "Travel/Japan/Kyoto temple",
+		NFile:     3,
+		CreatedAt: time.Now(),
+	}
+	if err := AddPost(g.db, p); err != nil {
+		t.Fatal(err)
+	}
+	p.Tags = []string{"kyoto"}
+	if err := UpdatePost(g.db, p); err != nil {
+		t.Fatal(err)
+	}
+	var category, tags string
+	if err := g.db.QueryRow("SELECT category, tags FROM posts WHERE folder_sha = 'sha'").Scan(&category, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if category != "Travel/Japan" || tags != "kyoto" {
+		t.Errorf("category, tags = %q, %q, want %q, %q", category, tags, "Travel/Japan", "kyoto")
+	}
+	if got, want := postTags(t, g.db, "sha"), []string{"kyoto"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("post_tags = %q, want %q", got, want)
+	}
+}
+
+func TestMigrateIndexesExistingPostsForSearch(t *testing.T) {
+	db := openLegacyDB(t)
+	if _, err := db.Exec("INSERT INTO posts VALUES ('sha', 'sha.md', 'Travel/Japan', 'Travel/Japan/Kyoto', '', 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	initSearchIndex(db)
+	// With -tags sqlite_fts5 this reads the index filled by the migration,
+	// otherwise the LIKE fallback
+	shas, err := SearchPosts(db, "kyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sha"}; !reflect.DeepEqual(shas, want) {
+		t.Errorf("SearchPosts(kyo) = %q, want %q", shas, want)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// naturalLess compares names the way people number files: digit runs compare
+// by value, so "IMG_2.jpg" sorts before "IMG_10.jpg", and letters compare
+// case-insensitively. Names equal under those rules fall back to byte order.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		ra, wa := utf8.DecodeRuneInString(a[i:])
+		rb, wb := utf8.DecodeRuneInString(b[j:])
+		if isDigit(ra) && isDigit(rb) {
+			ei, ej := digitRunEnd(a, i), digitRunEnd(b, j)
+			na := strings.TrimLeft(a[i:ei], "0")
+			nb := strings.TrimLeft(b[j:ej], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			i, j = ei, ej
+			continue
+		}
+		la, lb := unicode.ToLower(ra), unicode.ToLower(rb)
+		if la != lb {
+			return la < lb
+		}
+		i += wa
+		j += wb
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func digitRunEnd(s string, i int) int {
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+// sortNatural sorts names in place with naturalLess.
+func sortNatural(names []string) {
+	sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+}
+
+// mediaSorts are the accepted media_sort orders.
+var mediaSorts = map[string]bool{"name": true, "name_natural": true, "mtime_asc": true, "mtime_desc": true}
+
+// sortMedia sorts a folder's media names in place by media_sort. The mtime
+// orders take the modification times from the folder's entries and break
+// ties by natural name order.
+func sortMedia(order string, entries []os.DirEntry, names []string) {
+	switch order {
+	case "name":
+		sort.Strings(names)
+	case "mtime_asc", "mtime_desc":
+		mtimes := make(map[string]time.Time, len(names))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				mtimes[entry.Name()] = info.ModTime()
+			}
+		}
+		sort.Slice(names, func(i, j int) bool {
+			ti, tj := mtimes[names[i]], mtimes[names[j]]
+			if ti.Equal(tj) {
+				return naturalLess(names[i], names[j])
+			}
+			if order == "mtime_desc" {
+				return ti.After(tj)
+			}
+			return ti.Before(tj)
+		})
+	default:
+		sortNatural(names)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortNatural(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		{
+			[]string{"100.jpg", "10.jpg", "2.jpg", "1.jpg"},
+			[]string{"1.jpg", "2.jpg", "10.jpg", "100.jpg"},
+		},
+		{
+			[]string{"IMG_10.jpg", "img_2.jpg", "IMG_1.jpg", "DSC_3.jpg", "IMG_100.jpg"},
+			[]string{"DSC_3.jpg", "IMG_1.jpg", "img_2.jpg", "IMG_10.jpg", "IMG_100.jpg"},
+		},
+		{
+			[]string{"a10b2.jpg", "a2b10.jpg", "a2b2.jpg", "a10.jpg"},
+			[]string{"a2b2.jpg", "a2b10.jpg", "a10.jpg", "a10b2.jpg"},
+		},
+		{
+			[]string{"02.jpg", "2.jpg", "1.jpg", "001.jpg"},
+			[]string{"001.jpg", "1.jpg", "02.jpg", "2.jpg"},
+		},
+		{
+			[]string{"b.jpg", "10.jpg", "a.jpg", "9.jpg"},
+			[]string{"9.jpg", "10.jpg", "a.jpg", "b.jpg"},
+		},
+	}
+	for _, tt := range tests {
+		got := append([]string(nil), tt.in...)
+		sortNatural(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortNatural(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchFolders follows changes under WatchDir as set by watch_mode: fsnotify
+// events, periodic rescans, or events with a switch to rescans when WatchDir
+// cannot be watched.
+func watchFolders(ctx context.Context, config Config, db *sql.DB, ip *ImageProcessor, rs *Rescanner) {
+	if config.WatchMode != "poll" {
+		err := WatchFolders(ctx, config, db, ip)
+		if err == nil {
+			return
+		}
+		if config.WatchMode != "auto" {
+			slog.Error("Watching folders failed, set watch_mode = poll to rescan periodically", "err", err)
+			return
+		}
+		slog.Warn("Watching folders failed, falling back to polling", "err", err)
+	}
+	PollFolders(ctx, config, rs)
+}
+
+// PollFolders rescans WatchDir every poll_interval_seconds until ctx is
+// cancelled, for file systems that deliver no change events. The scan is the
+// startup one, so only new or changed folders are rewritten.
+func PollFolders(ctx context.Context, config Config, rs *Rescanner) {
+	interval := time.Duration(config.PollIntervalSeconds) * time.Second
+	slog.Info("Polling watched folders", "path", config.WatchDir, "interval", interval)
+	metrics.polling.Store(true)
+	defer metrics.polling.Store(false)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			folders, _ := CountPosts(rs.db)
+			if !rs.TryRun() {
+				slog.Debug("Folder scan already running, skipping poll")
+				continue
+			}
+			if n, _ := CountPosts(rs.db); scanStats.updated.Load() > 0 || n != folders {
+				rebuildHugo(config)
+			}
+		}
+	}
+}
+
+// subtreePoller rescans the folders that could not be watched because the
+// inotify watch limit was reached.
+type subtreePoller struct {
+	mu    sync.Mutex
+	roots map[string]bool // topmost unwatched folders
+	seen  map[string]bool // folders found below roots by the last poll
+}
+
+func newSubtreePoller() *subtreePoller {
+	return &subtreePoller{roots: make(map[string]bool), seen: make(map[string]bool)}
+}
+
+// Add polls dir from now on, unless it lies below a polled folder already.
+func (p *subtreePoller) Add(dir string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for root := range p.roots {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return false
+		}
+	}
+	p.roots[dir] = true
+	return true
+}
+
+// Poll walks the polled folders, writing the posts of new or changed ones
+// and removing those of vanished ones, and returns how many it found. The
+// first poll after startup only records the folders, which the startup scan
+// has already handled.
+func (p *subtreePoller) Poll(config Config, db *sql.DB, ip *ImageProcessor, record bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	found := make(map[string]bool)
+	ignore := newIgnoreMatcher(config)
+	changed := false
+	for root := range p.roots {
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			delete(p.roots, root)
+			continue
+		}
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if path != root && ignore.ignored(path, true) {
+				return filepath.SkipDir
+			}
+			found[path] = true
+			if !record && pollFolder(config, db, ip, ignore, path) {
+				changed = true
+			}
+			return nil
+		})
+	}
+	for path := range p.seen {
+		if !found[path] {
+			handleDeletedFolder(path, config, db)
+		}
+	}
+	p.seen = found
+	metrics.polledFolders.Store(int64(len(found)))
+	if changed {
+		rebuildHugo(config)
+	}
+	return len(found)
+}
+
+// pollFolder writes the post of a folder whose media changed since the last
+// scan, like the startup scan does, and reports whether it did. ignore is the
+// matcher of the poll or refresh calling it.
+func pollFolder(config Config, db *sql.DB, ip *ImageProcessor, ignore *ignoreMatcher, path string) bool {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return false
+	}
+	images, videos := classifyMedia(config, ignore, path, entries, nil, nil)
+	folderSHA := sha1Hex(path)
+	existingPath := GetRelPath(db, folderSHA)
+	if existingPath == "" && len(images)+len(videos) == 0 && len(albumChildren(config, path, entries)) == 0 {
+		return false
+	}
+	if existingPath != "" && GetContentHash(db, folderSHA) == folderHash(config, path, entries, images, videos) {
+		return false
+	}
+	if existingPath == "" {
+		handleNewFolderWithTemplate(path, config, dbStore{db}, ip, false, images, videos)
+	} else {
+		updatePost(dbStore{db}, path, images, videos, config)
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Post layouts of post_layout: every post in hugo_content_dir/post, or each
+// in the content folder of its categories, so that Hugo gives every category
+// a section page.
+const (
+	postLayoutFlat     = "post"
+	postLayoutCategory = "category"
+)
+
+// postDir returns the content folder of the post of the folder at relPath.
+// Folders directly in WatchDir have no category and stay in post/ either way.
+func postDir(config Config, relPath string) string {
+	categories := getCategories(relPath)
+	if config.PostLayout != postLayoutCategory || len(categories) == 0 {
+		return filepath.Join(config.ContentDir, "post")
+	}
+	return filepath.Join(append([]string{config.ContentDir}, categories...)...)
+}
+
+// postFilePath returns the markdown file of the post of the folder at
+// relPath; it is named after the folder SHA in every layout.
+func postFilePath(config Config, relPath, folderSHA string) string {
+	return filepath.Join(postDir(config, relPath), folderSHA+".md")
+}
+
+// makePostDir creates the content folder of the post at relPath. In the
+// category layout each category folder also gets an _index.md titled after
+// it, which Hugo needs to treat a nested folder as a section; existing ones
+// are left alone, so they can be edited.
+func makePostDir(config Config, relPath string) (string, error) {
+	dir := postDir(config, relPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if config.PostLayout != postLayoutCategory {
+		return dir, nil
+	}
+	section := config.ContentDir
+	for _, category := range getCategories(relPath) {
+		section = filepath.Join(section, category)
+		index := filepath.Join(section, "_index.md")
+		if _, err := os.Stat(index); err == nil {
+			continue
+		}
+		content := fmt.Sprintf("---\ntitle: %q\n---\n", category)
+		if err := os.WriteFile(index, []byte(content), 0644); err != nil {
+			slog.Warn("Writing section index failed", "path", index, "err", err)
+		}
+	}
+	return dir, nil
+}
+
+// isPostFile reports whether path, a markdown file below hugo_content_dir,
+// is a post this program writes: any file in post/, and elsewhere one named
+// after a folder SHA, so hand-written pages are never touched.
+func isPostFile(config Config, path string) bool {
+	name := filepath.Base(path)
+	sha, ok := strings.CutSuffix(name, ".md")
+	if !ok || name == "_index.md" {
+		return false
+	}
+	if filepath.Dir(path) == filepath.Join(config.ContentDir, "post") {
+		return true
+	}
+	return isFolderSHA(sha)
+}
+
+func isFolderSHA(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// postURL returns the URL Hugo gives the post of the folder at relPath with
+// its default settings, which lower-case the path and replace spaces with
+// hyphens.
+func postURL(config Config, relPath, folderSHA string) string {
+	dir, err := filepath.Rel(config.ContentDir, postDir(config, relPath))
+	if err != nil {
+		dir = "post"
+	}
+	segments := strings.Split(filepath.ToSlash(dir), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(strings.ReplaceAll(strings.ToLower(segment), " ", "-"))
+	}
+	return "/" + strings.Join(segments, "/") + "/" + folderSHA + "/"
+}
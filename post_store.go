@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// postStore records the posts written by handleNewFolderWithTemplate,
+// updatePost and writeAlbum, and answers the lookups a scan makes before
+// writing, so they see its own pending writes.
+type postStore interface {
+	AddPost(p Post) error
+	UpdatePost(p Post) error
+	RemovePost(folderSHA string) error
+	RelPath(folderSHA string) string
+	ContentHash(folderSHA string) string
+}
+
+// dbStore writes each post in a transaction of its own.
+type dbStore struct {
+	db *sql.DB
+}
+
+func (s dbStore) AddPost(p Post) error                { return AddPost(s.db, p) }
+func (s dbStore) UpdatePost(p Post) error             { return UpdatePost(s.db, p) }
+func (s dbStore) RemovePost(folderSHA string) error   { return RemovePost(s.db, folderSHA) }
+func (s dbStore) RelPath(folderSHA string) string     { return GetRelPath(s.db, folderSHA) }
+func (s dbStore) ContentHash(folderSHA string) string { return GetContentHash(s.db, folderSHA) }
+
+// A postBatch commits after this many writes, or once its transaction is
+// this old, so the API and other writers never wait long for dbMutex.
+const (
+	postBatchSize   = 500
+	postBatchMaxAge = 200 * time.Millisecond
+)
+
+// postBatch writes the posts of a folder scan through shared transactions
+// instead of one transaction each. Writes are visible to other connections
+// only once committed, but RelPath and ContentHash read through the open
+// transaction; call Flush when done. An open transaction holds dbMutex from
+// Begin to Commit, so other writers and the locked reads wait on dbMutex,
+// for at most postBatchMaxAge, rather than in SQLite's busy handler.
+type postBatch struct {
+	db     *sql.DB
+	mu     sync.Mutex
+	tx     *sql.Tx
+	writes int
+	err    error // first failed commit, reported by Flush
+}
+
+func newPostBatch(db *sql.DB) *postBatch {
+	return &postBatch{db: db}
+}
+
+func (b *postBatch) AddPost(p Post) error {
+	defer observeQuery("add_post", time.Now())
+	return b.write(func(tx *sql.Tx) error { return insertPost(tx, p) })
+}
+
+func (b *postBatch) UpdatePost(p Post) error {
+	defer observeQuery("update_post", time.Now())
+	return b.write(func(tx *sql.Tx) error { return updatePostRow(tx, p) })
+}
+
+func (b *postBatch) RemovePost(folderSHA string) error {
+	defer observeQuery("remove_post", time.Now())
+	return b.write(func(tx *sql.Tx) error { return deletePost(tx, folderSHA) })
+}
+
+func (b *postBatch) RelPath(folderSHA string) string {
+	defer observeQuery("get_rel_path", time.Now())
+	var relPath string
+	b.read("SELECT rel_path FROM posts WHERE folder_sha = ?", folderSHA, &relPath)
+	return relPath
+}
+
+func (b *postBatch) ContentHash(folderSHA string) string {
+	defer observeQuery("get_content_hash", time.Now())
+	var hash sql.NullString
+	b.read("SELECT content_hash FROM posts WHERE folder_sha = ?", folderSHA, &hash)
+	return hash.String
+}
+
+// read scans the single row of query into dest, through the open
+// transaction if there is one.
+func (b *postBatch) read(query string, folderSHA string, dest any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tx != nil {
+		b.tx.QueryRow(query, folderSHA).Scan(dest)
+		return
+	}
+	b.db.QueryRow(query, folderSHA).Scan(dest)
+}
+
+// write runs fn in the open transaction, beginning one if needed, under a
+// savepoint so a failed write leaves the rest of the batch intact.
+func (b *postBatch) write(fn func(tx *sql.Tx) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tx == nil {
+		dbMutex.Lock()
+		tx, err := b.db.Begin()
+		if err != nil {
+			dbMutex.Unlock()
+			return err
+		}
+		b.tx, b.writes = tx, 0
+		time.AfterFunc(postBatchMaxAge, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.tx == tx {
+				b.commit()
+			}
+		})
+	}
+	if _, err := b.tx.Exec("SAVEPOINT post"); err != nil {
+		return err
+	}
+	if err := fn(b.tx); err != nil {
+		b.tx.Exec("ROLLBACK TO post")
+		b.tx.Exec("RELEASE post")
+		return err
+	}
+	if _, err := b.tx.Exec("RELEASE post"); err != nil {
+		return err
+	}
+	b.writes++
+	if b.writes >= postBatchSize {
+		b.commit()
+	}
+	return nil
+}
+
+// commit ends the open transaction and releases the dbMutex it holds;
+// b.mu must be held.
+func (b *postBatch) commit() {
+	if err := b.tx.Commit(); err != nil && b.err == nil {
+		b.err = err
+	}
+	b.tx = nil
+	dbMutex.Unlock()
+}
+
+// Flush commits the pending writes and returns the first commit error.
+func (b *postBatch) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tx != nil {
+		b.commit()
+	}
+	return b.err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precomputeJob lists the images of a newly added folder to pregenerate.
+type precomputeJob struct {
+	folder   string
+	relPaths []string
+}
+
+// Precompute queues background generation of the precompute_widths variants
+// of relPaths. Jobs run one image at a time so they hold at most one slot of
+// jobSemaphore and never starve live requests.
+func (ip *ImageProcessor) Precompute(folder string, relPaths []string) {
+	if len(ip.precomputeWidths) == 0 || len(relPaths) == 0 {
+		return
+	}
+	select {
+	case ip.precomputeQueue <- precomputeJob{folder: folder, relPaths: relPaths}:
+	default:
+		slog.Warn("Precompute queue full, skipping thumbnails", "path", folder)
+	}
+}
+
+func (ip *ImageProcessor) runPrecompute() {
+	for job := range ip.precomputeQueue {
+		generated, cached, failed := 0, 0, 0
+		for _, relPath := range job.relPaths {
+			for _, width := range ip.precomputeWidths {
+				opts := ip.defaults
+				opts.Width = width
+				if _, err := os.Stat(ip.variantPath(relPath, opts)); err == nil {
+					cached++
+					continue
+				}
+				if err := ip.processWait(context.Background(), relPath, opts); err != nil {
+					slog.Error("Precomputing thumbnail failed", "path", relPath, "width", width, "err", err)
+					failed++
+					continue
+				}
+				generated++
+			}
+		}
+		slog.Info("Pregenerated thumbnails", "path", job.folder,
+			"generated", generated, "cached", cached, "failed", failed)
+	}
+}
+
+// WarmCache generates the thumbnails listed in a warm_cache_manifest file,
+// one at a time like Precompute, skipping those already cached, until ctx is
+// cancelled. Each line holds an image path relative to the image root and a
+// width, separated by whitespace; blank lines and # comments are ignored.
+func (ip *ImageProcessor) WarmCache(ctx context.Context, manifest string) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		slog.Error("Opening cache warming manifest failed", "path", manifest, "err", err)
+		return
+	}
+	defer f.Close()
+
+	generated, cached, failed := 0, 0, 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.LastIndexAny(text, " \t")
+		if i < 0 {
+			slog.Warn("Invalid cache warming entry, expected path and width", "path", manifest, "line", line)
+			failed++
+			continue
+		}
+		relPath := strings.TrimSpace(text[:i])
+		width, err := strconv.Atoi(text[i+1:])
+		if err != nil || width <= 0 || !filepath.IsLocal(relPath) {
+			slog.Warn("Invalid cache warming entry, expected path and width", "path", manifest, "line", line)
+			failed++
+			continue
+		}
+
+		opts := ip.defaults
+		opts.Width = width
+		if _, err := os.Stat(ip.variantPath(relPath, opts)); err == nil {
+			cached++
+			continue
+		}
+		if err := ip.processWait(ctx, relPath, opts); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Warming cache failed", "path", relPath, "width", width, "err", err)
+			failed++
+			continue
+		}
+		generated++
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Reading cache warming manifest failed", "path", manifest, "err", err)
+	}
+	slog.Info("Warmed image cache", "manifest", manifest,
+		"generated", generated, "cached", cached, "failed", failed)
+}
+
+// processWait is ProcessImage for background callers: when no slot is free
+// it waits for the queued job instead of returning errTooManyResizes.
+func (ip *ImageProcessor) processWait(ctx context.Context, relPath string, opts ImageOptions) error {
+	for {
+		_, err := ip.ProcessImage(ctx, relPath, opts)
+		if !errors.Is(err, errTooManyResizes) {
+			return err
+		}
+		// The job is now running in the background; the next call either
+		// waits on it or finds the cached file.
+	}
+}
+
+// imageRelPaths joins a folder's image names to its path relative to the
+// image root.
+func imageRelPaths(relDir string, images []string) []string {
+	relPaths := make([]string, len(images))
+	for i, name := range images {
+		relPaths[i] = filepath.Join(relDir, name)
+	}
+	return relPaths
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Client limiters idle for this long are dropped.
+const rateLimiterIdle = 3 * time.Minute
+
+// ipRateLimiter keeps a token bucket per client IP.
+type ipRateLimiter struct {
+	rate     rate.Limit
+	burst    int
+	trusted  []*net.IPNet
+	limiters map[string]*clientLimiter
+	mux      sync.Mutex
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPRateLimiter(perSec float64, burst int, trustedProxies []string) *ipRateLimiter {
+	rl := &ipRateLimiter{
+		rate:     rate.Limit(perSec),
+		burst:    burst,
+		trusted:  parseTrustedProxies(trustedProxies),
+		limiters: make(map[string]*clientLimiter),
+	}
+	go rl.cleanup()
+	return rl
+}
+
+// SetLimit changes the rate and burst of every client; a rate of 0 turns
+// limiting off.
+func (rl *ipRateLimiter) SetLimit(perSec float64, burst int) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	rl.rate, rl.burst = rate.Limit(perSec), burst
+	for _, cl := range rl.limiters {
+		cl.limiter.SetLimit(rl.rate)
+		cl.limiter.SetBurst(rl.burst)
+	}
+}
+
+func (rl *ipRateLimiter) enabled() bool {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	return rl.rate > 0
+}
+
+// reserve takes a token for ip, returning how long the client has to wait
+// when the bucket is empty.
+func (rl *ipRateLimiter) reserve(ip string) (bool, time.Duration) {
+	rl.mux.Lock()
+	cl, ok := rl.limiters[ip]
+	if !ok {
+		cl = &clientLimiter{limiter: rate.NewLimiter(rl.rate, rl.burst)}
+		rl.limiters[ip] = cl
+	}
+	cl.lastSeen = time.Now()
+	rl.mux.Unlock()
+
+	r := cl.limiter.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+func (rl *ipRateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		rl.mux.Lock()
+		for ip, cl := range rl.limiters {
+			if time.Since(cl.lastSeen) > rateLimiterIdle {
+				delete(rl.limiters, ip)
+			}
+		}
+		rl.mux.Unlock()
+	}
+}
+
+func (rl *ipRateLimiter) clientIP(r *http.Request) string {
+	return clientIP(r, rl.trusted)
+}
+
+// clientIP returns the request's client address. X-Forwarded-For is only
+// trusted when the connection comes from a trusted proxy, and then the
+// rightmost address not belonging to a trusted proxy is used.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host, trusted) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop != "" && !isTrusted(hop, trusted) {
+			return hop
+		}
+	}
+	return host
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies converts IPs and CIDRs to networks, skipping invalid
+// entries (LoadConfig has already rejected them).
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// withRateLimit answers 429 with Retry-After once a client exceeds its rate.
+// Requests pass through while the limiter's rate is 0.
+func withRateLimit(rl *ipRateLimiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rl.enabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ok, delay := rl.reserve(rl.clientIP(r)); !ok {
+			noteCacheOutcome(r, "rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
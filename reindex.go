@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reindex rebuilds the posts table from the front matter of the markdown
+// posts in hugo_content_dir, in either post_layout, for when the database is
+// lost but the posts survive; the photo folders need not be reachable. Each post's SHA comes from
+// its file name, and rel_path, n_file, tags, date and cover from its front
+// matter. Posts without rel_path, written by an older or custom archetype, are
+// skipped. Content hashes are left empty, so the next scan rewrites every post
+// whose folder is available. It returns the number of posts recorded.
+func Reindex(config Config, db *sql.DB) (int, error) {
+	var files []string
+	err := filepath.WalkDir(config.ContentDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isPostFile(config, path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("no posts found in %s", config.ContentDir)
+	}
+
+	n := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			slog.Error("Reading post failed", "path", file, "err", err)
+			continue
+		}
+		p, err := postFromFrontMatter(config, filepath.Base(file), data)
+		if err != nil {
+			slog.Warn("Skipping post", "path", file, "err", err)
+			continue
+		}
+		if err := AddPost(db, p); err != nil {
+			return n, fmt.Errorf("recording %s: %w", file, err)
+		}
+		slog.Debug("Reindexed post", "sha", p.FolderSHA, "path", p.RelPath, "files", p.NFile)
+		n++
+	}
+	return n, nil
+}
+
+// postFromFrontMatter rebuilds the database row of the post file postFile
+// from its front matter.
+func postFromFrontMatter(config Config, postFile string, data []byte) (Post, error) {
+	fields := parseFrontMatter(data)
+	rawPath, ok := fields["rel_path"]
+	if !ok {
+		return Post{}, fmt.Errorf("no rel_path in front matter")
+	}
+	relPath, err := strconv.Unquote(rawPath)
+	if err != nil {
+		return Post{}, fmt.Errorf("invalid rel_path %s: %w", rawPath, err)
+	}
+	nFile, err := strconv.Atoi(fields["n_file"])
+	if err != nil {
+		return Post{}, fmt.Errorf("invalid n_file %q", fields["n_file"])
+	}
+
+	p := Post{
+		FolderSHA: strings.TrimSuffix(postFile, ".md"),
+		PostFile:  postFile,
+		Category:  strings.Join(getCategories(relPath), "/"),
+		Tags:      parseFrontMatterList(fields["tags"]),
+		RelPath:   relPath,
+		ParentSHA: parentSHA(config, filepath.Join(config.WatchDir, relPath)),
+		NFile:     nFile,
+		CreatedAt: time.Now(),
+	}
+	if date, err := time.Parse(time.RFC3339, fields["date"]); err == nil {
+		p.CreatedAt = date
+	}
+	// The cover is the query-escaped name in its /images/{sha1}/{name}?w= URL
+	if image, err := strconv.Unquote(fields["cover.image"]); err == nil {
+		image, _, _ = strings.Cut(image, "?")
+		if name, ok := strings.CutPrefix(image, "/images/"+p.FolderSHA+"/"); ok {
+			if cover, err := url.QueryUnescape(name); err == nil {
+				p.Cover = cover
+			}
+		}
+	}
+	return p, nil
+}
+
+// parseFrontMatter returns the scalar values of the YAML front matter at the
+// start of a post, keyed by name; values one level down are keyed as
+// parent.name. It understands the flat front matter archetypes write, not
+// YAML in general.
+func parseFrontMatter(data []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "---" {
+		return fields
+	}
+	parent := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "---" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "#") {
+			value = ""
+		} else if i := strings.Index(value, " #"); i >= 0 && !strings.HasPrefix(value, `"`) {
+			value = strings.TrimSpace(value[:i])
+		}
+		if strings.HasPrefix(line, " ") {
+			if parent != "" {
+				fields[parent+"."+strings.TrimSpace(key)] = value
+			}
+			continue
+		}
+		parent = key
+		fields[key] = value
+	}
+	return fields
+}
+
+// parseFrontMatterList splits an inline list such as ["a", "b"].
+func parseFrontMatterList(value string) []string {
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if value == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if unquoted, err := strconv.Unquote(item); err == nil {
+			item = unquoted
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// hotReloadKeys are the config.ini keys applied by SIGHUP without a restart.
+// Every other key needs a restart.
+var hotReloadKeys = map[string]bool{
+	"image_cache_expiration_minutes": true,
+	"verbose":                        true,
+	"log_level":                      true,
+	"jpeg_quality":                   true,
+	"image_rate_per_sec":             true,
+	"image_rate_burst":               true,
+}
+
+var (
+	liveConfig  atomic.Pointer[Config] // the running config, updated on reload
+	reloadHooks []func(Config)         // components to notify after a reload
+	reloadMux   sync.Mutex             // protects reloadHooks and serializes reloads
+)
+
+// currentConfig returns the running config, including hot-reloaded values.
+func currentConfig() Config {
+	if config := liveConfig.Load(); config != nil {
+		return *config
+	}
+	return Config{}
+}
+
+// onConfigReload registers fn to be called with the new config after a reload.
+func onConfigReload(fn func(Config)) {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// reloadConfig re-reads path and applies the hotReloadKeys, logging every
+// change and the changed keys that need a restart.
+func reloadConfig(path string) {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	old := currentConfig()
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the running config", "err", err)
+		return
+	}
+	merged := old
+	oldValue, loadedValue := reflect.ValueOf(old), reflect.ValueOf(loaded)
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	changed := 0
+	for i := 0; i < oldValue.NumField(); i++ {
+		key := oldValue.Type().Field(i).Tag.Get("ini")
+		before, after := oldValue.Field(i).Interface(), loadedValue.Field(i).Interface()
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		if hotReloadKeys[key] {
+			mergedValue.Field(i).Set(loadedValue.Field(i))
+			slog.Info("Config reloaded", "key", key, "old", before, "new", after)
+			changed++
+		} else {
+			slog.Warn("Config key changed but requires a restart", "key", key)
+		}
+	}
+	if changed == 0 {
+		slog.Info("Config reload found no hot-reloadable changes")
+		return
+	}
+
+	liveConfig.Store(&merged)
+	for _, fn := range reloadHooks {
+		fn(merged)
+	}
+}
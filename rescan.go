@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rescanner runs full folder scans, one at a time, for startup and for
+// POST /api/rescan.
+type Rescanner struct {
+	config Config
+	db     *sql.DB
+	ip     *ImageProcessor
+
+	runMux     sync.Mutex // held while a scan runs
+	stateMux   sync.Mutex // protects the fields below
+	running    bool
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+func NewRescanner(config Config, db *sql.DB, ip *ImageProcessor) *Rescanner {
+	return &Rescanner{config: config, db: db, ip: ip}
+}
+
+// Run scans every folder, runs housekeeping and requests a Hugo build. It
+// waits for a scan already in progress.
+func (rs *Rescanner) Run() {
+	rs.runMux.Lock()
+	rs.run()
+}
+
+// Start runs a scan in the background unless one is already in progress.
+func (rs *Rescanner) Start() bool {
+	if !rs.runMux.TryLock() {
+		return false
+	}
+	go rs.run()
+	return true
+}
+
+// TryRun scans like Run, but returns false at once when a scan is already
+// in progress.
+func (rs *Rescanner) TryRun() bool {
+	if !rs.runMux.TryLock() {
+		return false
+	}
+	rs.run()
+	return true
+}
+
+// run does the scan; the caller holds runMux.
+func (rs *Rescanner) run() {
+	defer rs.runMux.Unlock()
+	rs.stateMux.Lock()
+	rs.running, rs.startedAt = true, time.Now()
+	rs.stateMux.Unlock()
+
+	InitScanFolders(rs.config, rs.db, rs.ip)
+	houseKeeping(rs.config, rs.db)
+
+	rs.stateMux.Lock()
+	rs.running, rs.finishedAt = false, time.Now()
+	rs.stateMux.Unlock()
+	slog.Info("Folder scan finished", "took", rs.finishedAt.Sub(rs.startedAt),
+		"folders", scanStats.scanned.Load(), "updated", scanStats.updated.Load())
+}
+
+// RescanStatus reports the running or last scan.
+type RescanStatus struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Discovered int64      `json:"folders_discovered"`
+	Scanned    int64      `json:"folders_scanned"`
+	Updated    int64      `json:"folders_updated"`
+}
+
+func (rs *Rescanner) Status() RescanStatus {
+	rs.stateMux.Lock()
+	defer rs.stateMux.Unlock()
+	st := RescanStatus{
+		Running:    rs.running,
+		Discovered: scanStats.discovered.Load(),
+		Scanned:    scanStats.scanned.Load(),
+		Updated:    scanStats.updated.Load(),
+	}
+	if !rs.startedAt.IsZero() {
+		startedAt := rs.startedAt
+		st.StartedAt = &startedAt
+	}
+	if !rs.running && !rs.finishedAt.IsZero() {
+		finishedAt := rs.finishedAt
+		st.FinishedAt = &finishedAt
+	}
+	return st
+}
+
+// handleRescan serves POST /api/rescan, answering 202 once a background scan
+// started and 409 when one is already running.
+func handleRescan(config Config, rs *Rescanner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !rs.Start() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, rs.Status())
+			return
+		}
+		slog.Info("Rescan requested", "remote", r.RemoteAddr)
+		// Build once the scan's posts are written; the idle timer coalesces it
+		go func() {
+			rs.runMux.Lock()
+			rs.runMux.Unlock()
+			rebuildHugo(config)
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, rs.Status())
+	}
+}
+
+type refreshResult struct {
+	FolderSHA string `json:"folder_sha"`
+	NFile     int    `json:"n_file"`
+}
+
+// handleRefreshPost serves POST /api/posts/{sha1}/refresh, rewriting one
+// post from its folder without a full rescan and scheduling a rebuild. It
+// answers 404 for an unknown post and 410 when its folder is gone, in which
+// case the stale post is removed.
+func handleRefreshPost(config Config, db *sql.DB, ip *ImageProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		folderSHA, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/posts/"), "/refresh")
+		if !ok || folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		relPath := GetRelPath(db, folderSHA)
+		if relPath == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		path := filepath.Join(config.WatchDir, relPath)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			slog.Info("Refresh requested for a removed folder, removing post", "sha", folderSHA, "path", path)
+			handleDeletedFolder(path, config, db)
+			http.Error(w, "Folder no longer exists", http.StatusGone)
+			return
+		}
+		slog.Info("Refresh requested", "sha", folderSHA, "path", path, "remote", r.RemoteAddr)
+		refreshFolder(path, config, db, ip)
+
+		result := refreshResult{FolderSHA: folderSHA}
+		if entries, err := os.ReadDir(path); err == nil {
+			images, videos := classifyMedia(config, newIgnoreMatcher(config), path, entries, nil, nil)
+			result.NFile = len(images) + len(videos)
+		}
+		writeJSON(w, result)
+	}
+}
+
+type postRecord struct {
+	apiPost
+	PostFile     string `json:"post_file"`
+	RelPath      string `json:"rel_path"`
+	Path         string `json:"path"`
+	FolderExists bool   `json:"folder_exists"`
+}
+
+// handlePost serves GET /api/posts/{sha1}, returning the post's database
+// record and folder path, and DELETE /api/posts/{sha1}, removing the post
+// like a deleted folder would, whether or not the folder still exists.
+func handlePost(config Config, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		folderSHA := strings.TrimPrefix(r.URL.Path, "/api/posts/")
+		if folderSHA == "" || strings.Contains(folderSHA, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		post, err := GetPost(db, folderSHA)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			slog.Error("Reading post failed", "sha", folderSHA, "err", err)
+			http.Error(w, "Error reading post", http.StatusInternalServerError)
+			return
+		}
+		path := filepath.Join(config.WatchDir, post.RelPath)
+
+		if r.Method == http.MethodDelete {
+			slog.Info("Post deletion requested", "sha", folderSHA, "path", path, "remote", r.RemoteAddr)
+			handleDeletedFolder(path, config, db)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, statErr := os.Stat(path)
+		writeJSON(w, postRecord{
+			apiPost:      newAPIPost(post),
+			PostFile:     post.PostFile,
+			RelPath:      post.RelPath,
+			Path:         path,
+			FolderExists: statErr == nil,
+		})
+	}
+}
+
+// handleRescanStatus serves GET /api/rescan/status.
+func handleRescanStatus(rs *Rescanner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, rs.Status())
+	}
+}
+
+// withAdmin restricts h to authenticated users; without basic auth only
+// loopback clients may use it. A reverse proxy on the same host connects
+// from loopback too, so requests it forwards are refused: anything from a
+// trusted_proxy, or carrying a forwarding header.
+func withAdmin(config Config, h http.Handler) http.Handler {
+	if authEnabled(config) {
+		// The whole server is already behind withBasicAuth
+		return h
+	}
+	trusted := parseTrustedProxies(config.TrustedProxies)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() ||
+			isTrusted(host, trusted) || isForwarded(r) {
+			http.Error(w, "Forbidden: configure auth_user to use this endpoint remotely", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isForwarded reports whether r was relayed by a proxy.
+func isForwarded(r *http.Request) bool {
+	for _, name := range []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"} {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
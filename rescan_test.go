@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAdminRefusesProxiedRequests(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	config := Config{TrustedProxies: []string{"127.0.0.2"}}
+	h := withAdmin(config, ok)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       int
+	}{
+		{"loopback", "127.0.0.1:5000", "", http.StatusOK},
+		{"ipv6 loopback", "[::1]:5000", "", http.StatusOK},
+		{"remote", "192.0.2.1:5000", "", http.StatusForbidden},
+		{"forwarded for", "127.0.0.1:5000", "X-Forwarded-For", http.StatusForbidden},
+		{"real ip", "127.0.0.1:5000", "X-Real-IP", http.StatusForbidden},
+		{"forwarded", "127.0.0.1:5000", "Forwarded", http.StatusForbidden},
+		{"trusted proxy", "127.0.0.2:5000", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/rescan", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			r.Header.Set(tt.header, "192.0.2.1")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	config.AuthUser = "admin"
+	r := httptest.NewRequest(http.MethodPost, "/api/rescan", nil)
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rec := httptest.NewRecorder()
+	withAdmin(config, ok).ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("with auth_user: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -1,72 +1,579 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func ServeHugo(config Config, imageProcessor *ImageProcessor, db *sql.DB) error {
-	http.Handle("/", http.FileServer(http.Dir(config.HugoOutDir)))
-	http.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+// Time allowed for in-flight requests to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// ServeHugo serves the site and the media endpoints until ctx is cancelled,
+// then stops accepting connections and waits up to shutdownTimeout for
+// in-flight requests.
+func ServeHugo(ctx context.Context, config Config, imageProcessor *ImageProcessor, db *sql.DB, rescanner *Rescanner) error {
+	var site http.Handler = http.FileServer(http.Dir(config.HugoOutDir))
+	if config.EnableGzip {
+		site = withCompression(site)
+	}
+	http.Handle("/", site)
+	imageLimiter := newIPRateLimiter(config.ImageRatePerSec, config.ImageRateBurst, config.TrustedProxies)
+	onConfigReload(func(c Config) { imageLimiter.SetLimit(c.ImageRatePerSec, c.ImageRateBurst) })
+	http.Handle("/images/", withRateLimit(imageLimiter, withGalleryPassword(config, db, "/images/", handleImages(config, db, imageProcessor))))
+
+	http.Handle("/images/srcset/", withRateLimit(imageLimiter, withGalleryPassword(config, db, "/images/srcset/", handleSrcset(config, db, imageProcessor))))
+	http.Handle("/contactsheet/", withRateLimit(imageLimiter, withGalleryPassword(config, db, "/contactsheet/", handleContactSheet(config, db, imageProcessor))))
+
+	http.Handle("/thumbnails/", withGalleryPassword(config, db, "/thumbnails/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/thumbnails/"), "/", 2)
+		if len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+
+		width, err := parseSizeParam(r.URL.Query().Get("w"))
+		if err != nil {
+			http.Error(w, "Invalid width parameter", http.StatusBadRequest)
+			return
+		}
+
+		folderSHA := parts[0]
+		relPath, ok := mediaRelPath(db, folderSHA, parts[1])
+		if !ok || !isInSlice(mediaExt(config, filepath.Join(config.ImageRoot, relPath)), config.VideoExts) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := os.Stat(filepath.Join(config.ImageRoot, relPath)); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		servedPath, err := imageProcessor.VideoThumbnail(r.Context(), relPath, width)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			if errors.Is(err, errTooManyResizes) {
+				w.Header().Set("Retry-After", "5")
+				http.Error(w, "Server busy, try again later", http.StatusAccepted)
+			} else {
+				http.Error(w, "Error generating thumbnail", http.StatusInternalServerError)
+			}
+			slog.Error("Video thumbnail failed", "sha", folderSHA, "path", relPath, "width", width, "err", err)
+			return
+		}
+
+		slog.Debug("Serving thumbnail", "sha", folderSHA, "path", servedPath, "width", width)
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeFile(w, r, servedPath)
+	})))
+
+	http.Handle("/videos/", withGalleryPassword(config, db, "/videos/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/videos/"), "/", 2)
+		if len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+
+		folderSHA := parts[0]
+		relPath, ok := mediaRelPath(db, folderSHA, parts[1])
+		if !ok || !isInSlice(mediaExt(config, filepath.Join(config.ImageRoot, relPath)), config.VideoExts) {
+			http.NotFound(w, r)
+			return
+		}
+		servedPath := filepath.Join(config.ImageRoot, relPath)
+
+		slog.Debug("Serving video", "sha", folderSHA, "path", servedPath, "range", r.Header.Get("Range"))
+
+		serveVideo(w, r, servedPath)
+	})))
+
+	http.Handle("/blurhash/", withGalleryPassword(config, db, "/blurhash/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/blurhash/"), "/", 2)
+		if len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+
+		folderSHA := parts[0]
+		relPath, ok := mediaRelPath(db, folderSHA, parts[1])
+		if !ok || !isInSlice(mediaExt(config, filepath.Join(config.ImageRoot, relPath)), config.PhotoExts) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := os.Stat(filepath.Join(config.ImageRoot, relPath)); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		hash, err := imageProcessor.Blurhash(r.Context(), relPath)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			if errors.Is(err, errTooManyResizes) {
+				w.Header().Set("Retry-After", "5")
+				http.Error(w, "Server busy, try again later", http.StatusAccepted)
+			} else {
+				http.Error(w, "Error computing blurhash", http.StatusInternalServerError)
+			}
+			slog.Error("Blurhash failed", "sha", folderSHA, "path", relPath, "err", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(hash))
+	})))
+
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, imageProcessor.Stats())
+	})
+	http.Handle("/status", withCredentials(config, handleStatus(db, imageProcessor)))
+
+	if config.EnableMetrics && config.MetricsPort == "" {
+		http.Handle("/metrics", handleMetrics(db, imageProcessor))
+		slog.Info("Serving Prometheus metrics at /metrics")
+	}
+
+	http.HandleFunc("/api/posts", handleListPosts(db))
+	refreshPost := withAdmin(config, handleRefreshPost(config, db, imageProcessor))
+	post := withAdmin(config, handlePost(config, db))
+	siblings := handlePostSiblings(db)
+	breadcrumbs := handleBreadcrumbs(db)
+	http.HandleFunc("/api/posts/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/refresh"):
+			refreshPost.ServeHTTP(w, r)
+		case strings.HasSuffix(r.URL.Path, "/breadcrumbs"):
+			breadcrumbs(w, r)
+		case !strings.Contains(strings.TrimPrefix(r.URL.Path, "/api/posts/"), "/"):
+			post.ServeHTTP(w, r)
+		default:
+			siblings(w, r)
+		}
+	})
+	http.HandleFunc("/api/tags", handleTags(db))
+	http.HandleFunc("/api/random", handleRandomImage(config, db))
+	http.HandleFunc("/feed.xml", handleFeed(config, db))
+	http.Handle("/download/", withGalleryPassword(config, db, "/download/", handleDownload(config, db)))
+	// At most one password guess per second per client, after a few
+	loginLimiter := newIPRateLimiter(1, 5, config.TrustedProxies)
+	http.Handle("/login/", withRateLimit(loginLimiter, handleGalleryLogin(config, db)))
+	http.Handle("/api/rescan", withAdmin(config, handleRescan(config, rescanner)))
+	http.Handle("/api/rescan/status", withAdmin(config, handleRescanStatus(rescanner)))
+
+	host := config.BindAddress
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	slog.Info("Serving Hugo site", "url", "http://"+net.JoinHostPort(host, config.ServerPort)+"/")
+	slog.Info("Serving images from mapped folders at /images/{sha1}/...")
+	slog.Info("Serving videos at /videos/{sha1}/...")
+	slog.Info("Serving srcset lists at /images/srcset/{sha1}/...")
+	slog.Info("Serving contact sheets at /contactsheet/{sha1}")
+	slog.Info("Serving video thumbnails at /thumbnails/{sha1}/...")
+	slog.Info("Serving blurhash placeholders at /blurhash/{sha1}/...")
+	slog.Info("Serving post list API at /api/posts")
+	slog.Info("Serving sibling post API at /api/posts/{sha1}/siblings")
+	slog.Info("Serving breadcrumbs API at /api/posts/{sha1}/breadcrumbs")
+	slog.Info("Serving post refresh API at /api/posts/{sha1}/refresh")
+	slog.Info("Serving post admin API at /api/posts/{sha1}")
+	slog.Info("Serving tag counts at /api/tags")
+	slog.Info("Serving random image redirects at /api/random")
+	slog.Info("Serving feed of new posts at /feed.xml", "format", config.FeedFormat)
+	slog.Info("Serving folder downloads at /download/{sha1}.zip")
+	slog.Info("Serving gallery logins at /login/{sha1}")
+	slog.Info("Serving rescan API at /api/rescan")
+	slog.Info("Serving instance status at /status")
+	var handler http.Handler = http.DefaultServeMux
+	if authEnabled(config) {
+		slog.Info("Basic authentication enabled", "user", config.AuthUser)
+		handler = withBasicAuth(config, handler)
+	}
+	// Probes must work without credentials, so /healthz sits outside auth
+	root := http.NewServeMux()
+	root.Handle("/healthz", handleHealth(config, db))
+	root.Handle("/", handler)
+	handler = withAccessLog(config.TrustedProxies, root)
+	slog.Info("Serving health check at /healthz")
+
+	servers := []*http.Server{newServer(config, config.ServerPort, handler)}
+	serveErr := make(chan error, 3)
+	if config.EnableMetrics && config.MetricsPort != "" {
+		// The admin listener has no auth; bind it where only the scraper reaches
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", handleMetrics(db, imageProcessor))
+		admin := newServer(config, config.MetricsPort, mux)
+		servers = append(servers, admin)
+		slog.Info("Serving Prometheus metrics at /metrics", "port", config.MetricsPort)
+		go func() { serveErr <- admin.ListenAndServe() }()
+	}
+	if config.TLSCert == "" {
+		slog.Info("TLS disabled, serving plain HTTP", "port", config.ServerPort)
+		go func() { serveErr <- servers[0].ListenAndServe() }()
+	} else {
+		if config.HTTPRedirectPort != "" {
+			redirect := redirectToHTTPS(config)
+			servers = append(servers, redirect)
+			go func() { serveErr <- redirect.ListenAndServe() }()
+		}
+		slog.Info("TLS enabled, serving HTTPS", "port", config.ServerPort, "cert", config.TLSCert)
+		go func() { serveErr <- servers[0].ListenAndServeTLS(config.TLSCert, config.TLSKey) }()
+	}
+
+	var err error
+	select {
+	case err = <-serveErr:
+		// A listener failed to start; stop the others too
+	case <-ctx.Done():
+		slog.Info("Stopping HTTP server", "timeout", shutdownTimeout)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+			slog.Error("HTTP server shutdown failed", "err", shutdownErr)
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// handleImages serves GET /images/{sha1}/{file}: the photo itself, or a
+// resized, re-encoded copy per the w, h, q, format, mode and dpr parameters.
+func handleImages(config Config, db *sql.DB, imageProcessor *ImageProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/images/"), "/", 2)
 		if len(parts) < 2 {
 			http.NotFound(w, r)
 			return
 		}
 
-		// Parse width parameter
-		widthStr := r.URL.Query().Get("w")
-		var width int
-		if widthStr != "" {
-			var err error
-			width, err = strconv.Atoi(widthStr)
-			if err != nil || width < 0 {
-				http.Error(w, "Invalid width parameter", http.StatusBadRequest)
+		// Parse width and height parameters
+		width, err := parseSizeParam(r.URL.Query().Get("w"))
+		if err != nil {
+			http.Error(w, "Invalid width parameter", http.StatusBadRequest)
+			return
+		}
+		height, err := parseSizeParam(r.URL.Query().Get("h"))
+		if err != nil {
+			http.Error(w, "Invalid height parameter", http.StatusBadRequest)
+			return
+		}
+
+		// Per-request defaults come from the live config, which SIGHUP updates
+		live := currentConfig()
+		quality := live.JPEGQuality
+		if qualityStr := r.URL.Query().Get("q"); qualityStr != "" {
+			quality, err = strconv.Atoi(qualityStr)
+			if err != nil || quality < 1 || quality > 100 {
+				http.Error(w, "Invalid quality parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		format := live.OutputFormat
+		if formatStr := r.URL.Query().Get("format"); formatStr != "" {
+			format, err = parseOutputFormat(formatStr)
+			if err != nil {
+				http.Error(w, "Invalid format parameter", http.StatusBadRequest)
 				return
 			}
+		} else if live.NegotiateWebP && (width > 0 || height > 0) && (format == "" || format == "webp") {
+			// Thumbnails go out as WebP only to browsers that accept it
+			w.Header().Add("Vary", "Accept")
+			format = negotiateFormat(format, r.Header.Get("Accept"))
 		}
 
-		folderSHA, file := parts[0], parts[1]
-		fileName, _ := url.QueryUnescape(file)
-		fileDir := GetRelPath(db, folderSHA)
-		relPath := filepath.Join(fileDir, fileName)
+		mode, err := parseResizeMode(r.URL.Query().Get("mode"))
+		if err != nil {
+			http.Error(w, "Invalid mode parameter", http.StatusBadRequest)
+			return
+		}
+		dpr, err := parseDPRParam(r.URL.Query().Get("dpr"))
+		if err != nil {
+			http.Error(w, "Invalid dpr parameter", http.StatusBadRequest)
+			return
+		}
+
+		folderSHA := parts[0]
+		relPath, ok := mediaRelPath(db, folderSHA, parts[1])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
 		servedPath := filepath.Join(config.ImageRoot, relPath)
-		fileExt := strings.ToLower(filepath.Ext(fileName))
+		fileExt := mediaExt(config, servedPath)
+		opts := ImageOptions{
+			Width:         width,
+			Height:        height,
+			Format:        format,
+			Quality:       quality,
+			Mode:          mode,
+			StripMetadata: config.StripMetadata,
+		}
+		opts = applyDPR(servedPath, opts, dpr)
 
+		// Answer revalidations before doing any work; the ETag only changes
+		// when the variant options or the source file change.
+		srcInfo, err := os.Stat(servedPath)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		etag := imageETag(relPath, opts, srcInfo.ModTime())
+		w.Header().Set("ETag", etag)
+		if notModified(r, etag, srcInfo.ModTime()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		cacheOutcome := "original"
 		for _, ext := range config.PhotoExts {
 			if fileExt == ext {
-				var err error
-				servedPath, err = imageProcessor.ProcessImage(relPath, width)
+				variant := imageProcessor.variantPath(relPath, opts)
+				if _, err := os.Stat(variant); err == nil {
+					cacheOutcome = "hit"
+				} else if variant != "" {
+					cacheOutcome = "miss"
+				}
+				servedPath, err = imageProcessor.ProcessImage(r.Context(), relPath, opts)
 				if err != nil {
-					if strings.Contains(err.Error(), "short Huffman data") {
-						break // Corrupted JPEG, serve original
+					if r.Context().Err() != nil {
+						return // client gone; the resize still finishes and is cached
+					}
+					w.Header().Del("ETag")
+					if errors.Is(err, errUnsupportedImage) {
+						// Keep the grid intact rather than failing the request
+						slog.Warn("Photo cannot be decoded, serving placeholder", "sha", folderSHA, "path", relPath, "err", err)
+						if servedPath, err = corruptImagePlaceholder(r.Context(), config, imageProcessor, opts); err == nil {
+							cacheOutcome = "placeholder"
+							break
+						}
 					}
-					if strings.Contains(err.Error(), "too many concurrent resizes") {
+					if errors.Is(err, fs.ErrNotExist) {
+						// Removed since the stat above
+						http.NotFound(w, r)
+						return
+					}
+					if errors.Is(err, errTooManyResizes) {
+						noteCacheOutcome(r, "busy")
 						w.Header().Set("Retry-After", "5")
 						http.Error(w, "Server busy, try again later", http.StatusAccepted)
 					} else {
+						noteCacheOutcome(r, "error")
 						http.Error(w, "Error processing image", http.StatusInternalServerError)
 					}
-					log.Printf("[ERROR] Image processing error: %v", err)
+					slog.Error("Image processing failed", "sha", folderSHA, "path", relPath, "width", width, "err", err)
 					return
 				}
+				if servedPath != variant {
+					cacheOutcome = "original" // e.g. no upscaling
+				}
 				break
 			}
 		}
+		noteCacheOutcome(r, cacheOutcome)
 
-		if config.Verbose {
-			log.Printf("[DEBUG] Serving image: %s (width=%d) -> %s", r.URL.Path, width, servedPath)
-		}
+		slog.Debug("Serving image", "sha", folderSHA, "path", servedPath, "width", width, "height", height, "format", format)
 
+		if contentType := imageContentType(servedPath); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if cacheControl := imageCacheControl(config, cacheOutcome); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
 		http.ServeFile(w, r, servedPath)
-	})
+	}
+}
+
+// redirectToHTTPS returns a server for http_redirect_port that permanently
+// redirects every request to the HTTPS server.
+func redirectToHTTPS(config Config) *http.Server {
+	slog.Info("Redirecting HTTP to HTTPS", "port", config.HTTPRedirectPort)
+	return newServer(config, config.HTTPRedirectPort, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if config.ServerPort != "443" {
+			host = net.JoinHostPort(host, config.ServerPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+}
+
+// Longest max-age of originals served by /images/, which change in place.
+const originalMaxAge = 3600
+
+// imageCacheControl returns the Cache-Control header of an /images/ response
+// with the given cache outcome. Resized variants are cached as immutable for
+// image_cache_control_seconds when image_cache_key_source names them after
+// their source too. Otherwise they, originals and the placeholder of
+// undecodable photos are cached for at most an hour, then revalidated with
+// their ETag.
+func imageCacheControl(config Config, cacheOutcome string) string {
+	maxAge := config.ImageCacheControlSeconds
+	if maxAge <= 0 {
+		return ""
+	}
+	if config.ImageCacheKeySource && (cacheOutcome == "hit" || cacheOutcome == "miss") {
+		return fmt.Sprintf("public, max-age=%d, immutable", maxAge)
+	}
+	return fmt.Sprintf("public, max-age=%d", min(maxAge, originalMaxAge))
+}
+
+// corruptImagePlaceholder returns the image served in place of a photo that
+// cannot be decoded: corrupt_image_placeholder, or a gray box of the
+// requested size.
+func corruptImagePlaceholder(ctx context.Context, config Config, ip *ImageProcessor, opts ImageOptions) (string, error) {
+	if config.CorruptImagePlaceholder != "" {
+		return config.CorruptImagePlaceholder, nil
+	}
+	return ip.grayBox(ctx, opts.Width, opts.Height)
+}
+
+// newServer returns a server for port on bind_address with the
+// http_*_timeout_seconds timeouts applied.
+func newServer(config Config, port string, h http.Handler) *http.Server {
+	readTimeout := time.Duration(config.HTTPReadTimeoutSeconds) * time.Second
+	return &http.Server{
+		Addr:              net.JoinHostPort(config.BindAddress, port),
+		Handler:           h,
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      time.Duration(config.HTTPWriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(config.HTTPIdleTimeoutSeconds) * time.Second,
+	}
+}
+
+// clearWriteDeadline exempts a long download from http_write_timeout_seconds.
+func clearWriteDeadline(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Debug("Clearing the write deadline failed", "err", err)
+	}
+}
+
+// mediaRelPath resolves the escaped file name of a media URL to its path
+// relative to ImageRoot. It fails for unknown posts and for anything but a
+// file directly in the post's folder: names with a separator, which could
+// leave it ("..%2F..%2Fetc%2Fpasswd") or reach a subfolder with a password
+// of its own, and dotfiles such as .password. The name is unescaped after
+// ServeMux has cleaned the URL path, so that cleaning does not cover it.
+func mediaRelPath(db *sql.DB, folderSHA, file string) (string, bool) {
+	fileName, err := url.QueryUnescape(file)
+	if err != nil || fileName == "" || strings.HasPrefix(fileName, ".") || strings.ContainsAny(fileName, `/\`) {
+		return "", false
+	}
+	fileDir := GetRelPath(db, folderSHA)
+	if fileDir == "" {
+		return "", false
+	}
+	return safeJoin(fileDir, fileName)
+}
+
+// parseSizeParam parses an optional non-negative dimension query value.
+func parseSizeParam(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n, nil
+}
 
-	log.Printf("Serving Hugo site at http://localhost:%s/", config.ServerPort)
-	log.Printf("Serving images from mapped folders at /images/{sha1}/...")
-	return http.ListenAndServe(":"+config.ServerPort, nil)
+// Highest device pixel ratio accepted by the dpr parameter.
+const maxDPR = 4
+
+// parseDPRParam parses an optional device pixel ratio between 1 and maxDPR.
+func parseDPRParam(value string) (float64, error) {
+	if value == "" {
+		return 1, nil
+	}
+	dpr, err := strconv.ParseFloat(value, 64)
+	if err != nil || dpr < 1 || dpr > maxDPR {
+		return 0, fmt.Errorf("invalid dpr %q", value)
+	}
+	return dpr, nil
+}
+
+// acceptsMediaType reports whether an Accept header lists mediaType with a
+// non-zero quality.
+func acceptsMediaType(header, mediaType string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, _ := strconv.ParseFloat(value, 64)
+				return q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// negotiateFormat returns the format of a resized image for a client with the
+// given Accept header when the request names none: WebP in place of the source
+// format for clients that accept it, and JPEG in place of a configured WebP
+// for clients that do not.
+func negotiateFormat(format, accept string) string {
+	webp := acceptsMediaType(accept, "image/webp")
+	switch {
+	case format == "" && webp:
+		return "webp"
+	case format == "webp" && !webp:
+		return "jpeg"
+	}
+	return format
+}
+
+// imageETag returns a strong ETag for an image variant, derived from its cache
+// key and the source modification time.
+func imageETag(relPath string, opts ImageOptions, modTime time.Time) string {
+	return `"` + sha1Hex(fmt.Sprintf("%s_%d", cache_image_hash(relPath, opts), modTime.UnixNano())) + `"`
+}
+
+// notModified reports whether the request's If-None-Match or, without it,
+// If-Modified-Since shows the client already has the current response.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !modTime.Truncate(time.Second).After(ims)
+	}
+	return false
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestImagesServeOnlyDirectFilesOfGallery(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 8, 8, color.White)
+	public := g.addFolder(t, "Public", map[string][]byte{"a.jpg": jpg})
+	private := g.addFolder(t, "Public/Private", map[string][]byte{
+		"x.jpg":     jpg,
+		".password": []byte("secret\n"),
+	})
+	h := withGalleryPassword(g.config, g.db, "/images/", handleImages(g.config, g.db, g.ip))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/images/" + public + "/a.jpg", http.StatusOK},
+		{"/images/" + public + "/Private/x.jpg", http.StatusNotFound},
+		{"/images/" + public + "/Private%2Fx.jpg", http.StatusNotFound},
+		{"/images/" + public + "/Private/.password", http.StatusNotFound},
+		{"/images/" + public + "/Private%2F.password", http.StatusNotFound},
+		{"/images/" + private + "/x.jpg", http.StatusUnauthorized},
+		{"/images/" + private + "/.password", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestMediaRelPathRejectsHiddenFiles(t *testing.T) {
+	g := newTestGallery(t)
+	sha := g.addFolder(t, "Album", map[string][]byte{".password": []byte("secret")})
+	for _, file := range []string{".password", "%2Epassword", "", "..", "sub/a.jpg", `sub\a.jpg`} {
+		if rel, ok := mediaRelPath(g.db, sha, file); ok {
+			t.Errorf("mediaRelPath(%q) = %q, want rejected", file, rel)
+		}
+	}
+}
+
+func TestImagesRangeRequest(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 64, 64, color.White)
+	sha := g.addFolder(t, "Album", map[string][]byte{"a.jpg": jpg})
+	h := handleImages(g.config, g.db, g.ip)
+
+	r := httptest.NewRequest(http.MethodGet, "/images/"+sha+"/a.jpg", nil)
+	r.Header.Set("Range", "bytes=100-200")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes 100-200/%d", len(jpg)); got != want {
+		t.Errorf("Content-Range %q, want %q", got, want)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), jpg[100:201]) {
+		t.Errorf("body is not bytes 100-200 of the file")
+	}
+}
+
+func TestImagesNotFound(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 8, 8, color.White)
+	sha := g.addFolder(t, "Album", map[string][]byte{"a.jpg": jpg})
+	h := handleImages(g.config, g.db, g.ip)
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"unknown sha", "/images/" + sha1Hex("nowhere") + "/a.jpg"},
+		{"unknown sha resized", "/images/" + sha1Hex("nowhere") + "/a.jpg?w=100"},
+		{"missing file", "/images/" + sha + "/missing.jpg"},
+		{"missing file resized", "/images/" + sha + "/missing.jpg?w=100"},
+		{"no file", "/images/" + sha},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: GET %s = %d, want %d", tt.name, tt.path, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestImagesUseLiveConfig(t *testing.T) {
+	g := newTestGallery(t)
+	sha := g.addFolder(t, "Album", map[string][]byte{"a.jpg": testJPEG(t, 64, 64, color.White)})
+	h := handleImages(g.config, g.db, g.ip)
+
+	live := g.config
+	live.OutputFormat = "png"
+	setLiveConfig(t, live)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/images/"+sha+"/a.jpg?w=32", nil))
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type %q, want %q from the live output_format", got, "image/png")
+	}
+}
+
+func TestImagesNegotiateWebP(t *testing.T) {
+	g := newTestGallery(t)
+	sha := g.addFolder(t, "Album", map[string][]byte{"a.jpg": testJPEG(t, 64, 64, color.White)})
+	h := handleImages(g.config, g.db, g.ip)
+
+	tests := []struct {
+		outputFormat string
+		accept       string
+		want         string
+	}{
+		{"", "image/webp,*/*", "image/webp"},
+		{"", "image/png,*/*", "image/jpeg"},
+		{"webp", "image/webp,*/*", "image/webp"},
+		{"webp", "image/png,image/jpeg,*/*", "image/jpeg"},
+		{"png", "image/webp,*/*", "image/png"},
+	}
+	for _, tt := range tests {
+		live := g.config
+		live.OutputFormat = tt.outputFormat
+		live.NegotiateWebP = true
+		setLiveConfig(t, live)
+
+		r := httptest.NewRequest(http.MethodGet, "/images/"+sha+"/a.jpg?w=32", nil)
+		r.Header.Set("Accept", tt.accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if got := rec.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("output_format %q, Accept %q: Content-Type %q, want %q", tt.outputFormat, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateFormatKeepsConfiguredFormat(t *testing.T) {
+	for _, format := range []string{"avif", "png", "jpeg"} {
+		if got := negotiateFormat(format, "image/webp,*/*"); got != format {
+			t.Errorf("negotiateFormat(%q) = %q, want it kept", format, got)
+		}
+	}
+}
+
+func TestImageCacheControlImmutableOnlyWithSourceKey(t *testing.T) {
+	config := Config{ImageCacheControlSeconds: 31536000}
+	tests := []struct {
+		keySource bool
+		outcome   string
+		want      string
+	}{
+		{true, "hit", "public, max-age=31536000, immutable"},
+		{true, "miss", "public, max-age=31536000, immutable"},
+		{true, "original", "public, max-age=3600"},
+		{false, "hit", "public, max-age=3600"},
+		{false, "miss", "public, max-age=3600"},
+		{false, "placeholder", "public, max-age=3600"},
+	}
+	for _, tt := range tests {
+		config.ImageCacheKeySource = tt.keySource
+		if got := imageCacheControl(config, tt.outcome); got != tt.want {
+			t.Errorf("image_cache_key_source %v, %s: %q, want %q", tt.keySource, tt.outcome, got, tt.want)
+		}
+	}
+}
+
+func TestImagesBusyWhenNoResizeSlot(t *testing.T) {
+	g := newTestGallery(t)
+	sha := g.addFolder(t, "Album", map[string][]byte{"a.jpg": testJPEG(t, 64, 64, color.White)})
+	h := handleImages(g.config, g.db, g.ip)
+	for i := 0; i < cap(g.ip.jobSemaphore); i++ {
+		g.ip.jobSemaphore <- struct{}{}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/images/"+sha+"/a.jpg?w=32", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if got := rec.Header().Get("Retry-After"); got == "" {
+		t.Error("no Retry-After header")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Most widths a single srcset request may ask for.
+const maxSrcsetWidths = 8
+
+// handleSrcset serves GET /images/srcset/{sha1}/{file}?widths=300,800,1600
+// with a srcset attribute value listing the /images/ URL of each width. The
+// variants are generated through ProcessImage, so they share jobs with
+// concurrent /images/ requests; widths that find every job slot busy keep
+// generating in the background and are listed all the same.
+func handleSrcset(config Config, db *sql.DB, ip *ImageProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/images/srcset/"), "/", 2)
+		if len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+		folderSHA, file := parts[0], parts[1]
+		relPath, ok := mediaRelPath(db, folderSHA, file)
+		if !ok || !isInSlice(mediaExt(config, filepath.Join(config.ImageRoot, relPath)), config.PhotoExts) {
+			http.NotFound(w, r)
+			return
+		}
+		widths, err := parseWidths(r.URL.Query().Get("widths"))
+		if err != nil {
+			http.Error(w, "Invalid widths parameter", http.StatusBadRequest)
+			return
+		}
+
+		imageURL := "/images/" + folderSHA + "/" + file
+		var entries []string
+		seen := make(map[int]bool)
+		for _, width := range widths {
+			// List each allowed_widths variant once, by its actual width
+			width = ip.snapWidth(width)
+			if seen[width] {
+				continue
+			}
+			seen[width] = true
+			opts := defaultImageOptions(currentConfig())
+			opts.Width = width
+			servedPath, err := ip.ProcessImage(r.Context(), relPath, opts)
+			if r.Context().Err() != nil {
+				return
+			}
+			if err != nil && !errors.Is(err, errTooManyResizes) {
+				slog.Error("Image processing failed", "sha", folderSHA, "path", relPath, "width", width, "err", err)
+				http.Error(w, "Error processing image", http.StatusInternalServerError)
+				return
+			}
+			if err == nil && servedPath != ip.variantPath(relPath, opts) {
+				continue // the source is narrower than width
+			}
+			entries = append(entries, imageURL+"?w="+strconv.Itoa(width)+" "+strconv.Itoa(width)+"w")
+		}
+		if len(entries) == 0 {
+			entries = append(entries, imageURL)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.Join(entries, ", ")))
+	}
+}
+
+// parseWidths parses a comma-separated list of positive widths.
+func parseWidths(value string) ([]int, error) {
+	fields := strings.Split(value, ",")
+	if value == "" || len(fields) > maxSrcsetWidths {
+		return nil, fmt.Errorf("expected 1 to %d widths", maxSrcsetWidths)
+	}
+	widths := make([]int, 0, len(fields))
+	for _, field := range fields {
+		width, err := parseSizeParam(strings.TrimSpace(field))
+		if err != nil || width == 0 {
+			return nil, fmt.Errorf("invalid width %q", field)
+		}
+		widths = append(widths, width)
+	}
+	return widths, nil
+}
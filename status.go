@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// instanceStatus is the summary served by /status.
+type instanceStatus struct {
+	Posts            int        `json:"posts"`
+	MediaFiles       int        `json:"media_files"`
+	CacheBytes       int64      `json:"cache_bytes"`
+	CacheFiles       int        `json:"cache_files"`
+	LastBuild        *time.Time `json:"last_build"` // nil before the first build
+	LastBuildSeconds float64    `json:"last_build_seconds"`
+	LastBuildOK      bool       `json:"last_build_ok"`
+	BuildFailures    int64      `json:"build_failures"`
+	Watcher          string     `json:"watcher"` // watching, polling or stopped
+	WatchedFolders   int64      `json:"watched_folders"`
+	PolledFolders    int64      `json:"polled_folders"`
+	Ready            bool       `json:"ready"`
+	StartedAt        time.Time  `json:"started_at"`
+	UptimeSeconds    int64      `json:"uptime_seconds"`
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"humanSize": humanSize,
+	"duration":  func(seconds int64) time.Duration { return time.Duration(seconds) * time.Second },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width">
+<title>Gallery status</title></head>
+<body>
+<table>
+<tr><th>Posts</th><td>{{ .Posts }}</td></tr>
+<tr><th>Media files</th><td>{{ .MediaFiles }}</td></tr>
+<tr><th>Image cache</th><td>{{ humanSize .CacheBytes }} in {{ .CacheFiles }} files</td></tr>
+<tr><th>Last Hugo build</th><td>{{ with .LastBuild }}{{ .Format "2006-01-02 15:04:05" }}, {{ if $.LastBuildOK }}ok{{ else }}failed{{ end }} in {{ printf "%.1f" $.LastBuildSeconds }}s{{ else }}none yet{{ end }}{{ with .BuildFailures }} ({{ . }} failed since start){{ end }}</td></tr>
+<tr><th>Watcher</th><td>{{ .Watcher }}, {{ .WatchedFolders }} folders watched{{ with .PolledFolders }}, {{ . }} polled{{ end }}</td></tr>
+<tr><th>Initial scan</th><td>{{ if .Ready }}done{{ else }}running{{ end }}</td></tr>
+<tr><th>Uptime</th><td>{{ duration .UptimeSeconds }} since {{ .StartedAt.Format "2006-01-02 15:04:05" }}</td></tr>
+</table>
+</body></html>
+`))
+
+// handleStatus serves GET /status, a summary of the instance for its admin:
+// posts and media files in the database, the image cache, the last Hugo
+// build, the watcher and the uptime. It is an HTML table, or JSON when the
+// client accepts application/json.
+func handleStatus(db *sql.DB, ip *ImageProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := instanceStatus{
+			LastBuildSeconds: time.Duration(metrics.lastBuildNanos.Load()).Seconds(),
+			LastBuildOK:      !metrics.lastBuildFailed.Load(),
+			BuildFailures:    metrics.buildFailures.Load(),
+			Watcher:          "stopped",
+			WatchedFolders:   metrics.watchedFolders.Load(),
+			PolledFolders:    metrics.polledFolders.Load(),
+			Ready:            ready.Load(),
+			StartedAt:        metrics.started,
+			UptimeSeconds:    int64(time.Since(metrics.started).Seconds()),
+		}
+		var err error
+		if status.Posts, err = CountPosts(db); err == nil {
+			status.MediaFiles, err = CountMediaFiles(db)
+		}
+		if err != nil {
+			slog.Error("Counting posts failed", "err", err)
+			http.Error(w, "Error reading the database", http.StatusInternalServerError)
+			return
+		}
+		st := ip.Stats()
+		status.CacheBytes, status.CacheFiles = st.CacheBytes, st.CacheFiles
+		if unix := metrics.lastBuildUnix.Load(); unix > 0 {
+			last := time.Unix(unix, 0)
+			status.LastBuild = &last
+		}
+		switch {
+		case metrics.watching.Load():
+			status.Watcher = "watching"
+		case metrics.polling.Load():
+			status.Watcher = "polling"
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		if acceptsMediaType(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, status); err != nil {
+			slog.Error("Writing status page failed", "err", err)
+		}
+	}
+}
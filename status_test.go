@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRequiresCredentials(t *testing.T) {
+	g := newTestGallery(t)
+	tests := []struct {
+		name     string
+		authUser string
+		want     int
+	}{
+		{"no credentials configured", "", http.StatusForbidden},
+		{"credentials configured", "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		config := g.config
+		config.AuthUser = tt.authUser
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		r.RemoteAddr = "127.0.0.1:5000"
+		r.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		withCredentials(config, handleStatus(g.db, g.ip)).ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
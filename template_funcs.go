@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// slugify lower-cases s and joins its runs of letters and digits with
+// hyphens, e.g. "Summer Trip (2024)" becomes "summer-trip-2024". Letters of
+// any script are kept.
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
+
+// truncate shortens s to at most n characters, ending it with "…" when it
+// cut something. The length comes first so it can end a pipeline:
+// {{ .FolderName | truncate 30 }}.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if n < 0 || len(runes) <= n {
+		return s
+	}
+	if n == 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
+
+// thumbURL returns the /images/ URL of a post's file resized to width,
+// the original for a width of 0. The name is a path segment, so spaces
+// become %20 rather than +.
+func thumbURL(folderSHA, name string, width int) string {
+	u := "/images/" + folderSHA + "/" + url.PathEscape(name)
+	if width > 0 {
+		u += "?w=" + strconv.Itoa(width)
+	}
+	return u
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Summer Trip (2024)", "summer-trip-2024"},
+		{"  --Hello,  World!--  ", "hello-world"},
+		{"Été à Paris", "été-à-paris"},
+		{"東京 2024", "東京-2024"},
+		{"", ""},
+		{"!!!", ""},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.in); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		n        int
+		in, want string
+	}{
+		{0, "abc", ""},
+		{1, "abc", "…"},
+		{2, "abc", "a…"},
+		{3, "abc", "abc"},
+		{10, "abc", "abc"},
+		{-1, "abc", "abc"},
+		{0, "", ""},
+		{3, "日本語テキスト", "日本…"},
+		{4, "été à", "été…"},
+		{5, "été à", "été à"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.n, tt.in); got != tt.want {
+			t.Errorf("truncate(%d, %q) = %q, want %q", tt.n, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestThumbURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{"a.jpg", 400, "/images/sha/a.jpg?w=400"},
+		{"a.jpg", 0, "/images/sha/a.jpg"},
+		{"a b.jpg", 400, "/images/sha/a%20b.jpg?w=400"},
+		{"a#1.jpg", 0, "/images/sha/a%231.jpg"},
+		{"a?b.jpg", 0, "/images/sha/a%3Fb.jpg"},
+	}
+	for _, tt := range tests {
+		if got := thumbURL("sha", tt.name, tt.width); got != tt.want {
+			t.Errorf("thumbURL(%q, %d) = %q, want %q", tt.name, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestThumbURLIsServed(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 8, 8, color.White)
+	names := []string{"a b.jpg", "a#1.jpg"}
+	sha := g.addFolder(t, "Album", map[string][]byte{names[0]: jpg, names[1]: jpg})
+	h := handleImages(g.config, g.db, g.ip)
+	for _, name := range names {
+		u := thumbURL(sha, name, 0)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want %d", u, rec.Code, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ikawaha/kagome-dict/ipa"
+	"github.com/ikawaha/kagome/v2/tokenizer"
+)
+
+// tokenizers cut a folder name into candidate tags, by tag_language. The
+// skip-word and length filters of getTags apply to every one of them.
+var tokenizers = map[string]func(config Config, s string) []string{
+	"zh": cutChinese,
+	"ja": cutJapanese,
+	"en": cutWords,
+}
+
+var (
+	kagomeSingleton *tokenizer.Tokenizer
+	kagomeOnce      sync.Once
+)
+
+// tokenize cuts s with the tokenizer of tag_language, or with the one for
+// the dominant script of s when it is auto.
+func tokenize(config Config, s string) []string {
+	lang := config.TagLanguage
+	if lang == "auto" {
+		lang = detectLanguage(s)
+	}
+	return tokenizers[lang](config, s)
+}
+
+// detectLanguage guesses the language of s from its scripts: any kana means
+// Japanese, otherwise more Han than Latin letters means Chinese.
+func detectLanguage(s string) string {
+	var han, latin int
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			return "ja"
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	if han > latin {
+		return "zh"
+	}
+	return "en"
+}
+
+func cutChinese(config Config, s string) []string {
+	if !config.EnableJieba {
+		return nil
+	}
+	return getJieba().Cut(s, true)
+}
+
+// cutJapanese keeps the nouns found by kagome; particles and inflections
+// make poor tags.
+func cutJapanese(config Config, s string) []string {
+	kagomeOnce.Do(func() {
+		kagomeSingleton, _ = tokenizer.New(ipa.Dict(), tokenizer.OmitBosEos())
+	})
+	var words []string
+	for _, token := range kagomeSingleton.Tokenize(s) {
+		if pos := token.POS(); len(pos) > 0 && pos[0] == "名詞" {
+			words = append(words, token.Surface)
+		}
+	}
+	return words
+}
+
+// cutWords splits s into runs of letters and digits.
+func cutWords(config Config, s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
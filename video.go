@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var videoContentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+	".ts":   "video/mp2t",
+}
+
+// videoContentType returns the MIME type for a video path, or
+// application/octet-stream for unknown extensions.
+func videoContentType(path string) string {
+	if contentType, ok := videoContentTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// serveVideo streams the video at path. http.ServeContent answers Range
+// requests with 206 Partial Content so browsers can seek without
+// downloading the whole file.
+func serveVideo(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	clearWriteDeadline(w)
+
+	// http.ServeContent sniffs the type of a file without an extension
+	if filepath.Ext(path) != "" {
+		w.Header().Set("Content-Type", videoContentType(path))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// Offsets tried when grabbing a video frame; 0 covers clips shorter than 1s.
+var thumbnailOffsets = []string{"1", "0"}
+
+func video_thumbnail_path(originalPath string, cacheDir string, width int, version string) string {
+	hash := cache_image_hash(originalPath, ImageOptions{Width: width, SourceVersion: version})
+	return cacheFile(cacheDir, fmt.Sprintf("%s_thumb.jpg", hash))
+}
+
+// VideoThumbnail returns the path of a JPEG frame extracted from the video at
+// srcRelPath, scaled to width (0 keeps the video size). If ffmpeg is missing or
+// fails, a placeholder image is returned instead.
+func (ip *ImageProcessor) VideoThumbnail(ctx context.Context, srcRelPath string, width int) (string, error) {
+	width = ip.snapWidth(width)
+	if !ip.hasFFmpeg() {
+		return ip.placeholder(ctx, width)
+	}
+
+	srcPath := filepath.Join(ip.resourceDir, srcRelPath)
+	cachedPath := video_thumbnail_path(srcRelPath, ip.cacheDir, width, ip.sourceVersion(srcRelPath))
+	path, err := ip.generate(ctx, cachedPath, "", func() error {
+		return ip.extractFrame(srcPath, cachedPath, width)
+	})
+	if err != nil && !errors.Is(err, errTooManyResizes) && ctx.Err() == nil {
+		slog.Error("Video thumbnail failed", "path", srcRelPath, "width", width, "err", err)
+		return ip.placeholder(ctx, width)
+	}
+	return path, err
+}
+
+func (ip *ImageProcessor) hasFFmpeg() bool {
+	ip.ffmpegOnce.Do(func() {
+		_, err := exec.LookPath(ip.ffmpegPath)
+		ip.ffmpegFound = err == nil
+		if !ip.ffmpegFound {
+			slog.Warn("ffmpeg not found, video thumbnails will be placeholders", "path", ip.ffmpegPath)
+		}
+	})
+	return ip.ffmpegFound
+}
+
+func (ip *ImageProcessor) extractFrame(srcPath, destPath string, width int) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	var lastErr error
+	for _, offset := range thumbnailOffsets {
+		args := []string{"-v", "error", "-ss", offset, "-i", srcPath, "-frames:v", "1"}
+		if width > 0 {
+			args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", width))
+		}
+		args = append(args, "-y", destPath)
+		out, err := exec.Command(ip.ffmpegPath, args...).CombinedOutput()
+		if _, statErr := os.Stat(destPath); err == nil && statErr == nil {
+			return nil
+		}
+		lastErr = fmt.Errorf("ffmpeg failed at %ss: %v: %s", offset, err, out)
+	}
+	return lastErr
+}
+
+// placeholder returns a cached gray 16:9 image of the given width.
+func (ip *ImageProcessor) placeholder(ctx context.Context, width int) (string, error) {
+	return ip.grayBox(ctx, width, 0)
+}
+
+// grayBox returns a cached gray JPEG of width x height. A missing dimension
+// follows from the other at 16:9, and without either it is 640x360.
+func (ip *ImageProcessor) grayBox(ctx context.Context, width, height int) (string, error) {
+	switch {
+	case width <= 0 && height <= 0:
+		width, height = 640, 360
+	case height <= 0:
+		height = max(1, width*9/16)
+	case width <= 0:
+		width = max(1, height*16/9)
+	}
+	name := fmt.Sprintf("placeholder_%d.jpg", width)
+	if height != width*9/16 {
+		name = fmt.Sprintf("placeholder_%dx%d.jpg", width, height)
+	}
+	path := filepath.Join(ip.cacheDir, name)
+	return ip.generate(ctx, path, "", func() error {
+		if err := os.MkdirAll(ip.cacheDir, 0755); err != nil {
+			return fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		img := imaging.New(width, height, color.NRGBA{R: 128, G: 128, B: 128, A: 255})
+		return imaging.Save(img, path)
+	})
+}
@@ -1,19 +1,20 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strings"
 	"sync"
-	"text/template"
+	"syscall"
 	"time"
 	"unicode/utf8"
 
@@ -24,43 +25,145 @@ import (
 )
 
 var (
-	n_current      int
-	mu             sync.Mutex
 	jiebaSingleton *gojieba.Jieba
 	jiebaOnce      sync.Once
+	tagSkipSet     map[string]struct{} // words never used as tags
+	tagSkipOnce    sync.Once
 )
 
-func WatchFolders(config Config, db *sql.DB, tmpl *template.Template) {
+// How long a folder must see no file changes before its post is rewritten.
+const fileChangeDelay = 2 * time.Second
+
+// WatchFolders watches WatchDir for new, changed and removed folders until
+// ctx is cancelled. It returns an error at once when WatchDir itself cannot
+// be watched.
+func WatchFolders(ctx context.Context, config Config, db *sql.DB, ip *ImageProcessor) error {
 	watcher, err := fsnotify.NewWatcher()
 	watched_folder := mapset.NewSet[string]()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer watcher.Close()
+	go func() {
+		// Closing the watcher closes its channels and ends the event loop
+		<-ctx.Done()
+		watcher.Close()
+	}()
 	var wg sync.WaitGroup
+	poller := newSubtreePoller()
+	var limitOnce sync.Once
 
-	addWatchersRecursive := func(dir string) {
+	// addWatchersRecursive watches dir and every folder below it, returning
+	// the folders that were not watched before.
+	addWatchersRecursive := func(dir string) []string {
+		var added []string
 		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
-				log.Printf("WalkDir error on %s: %v", path, err)
+				slog.Error("Walking directory failed", "path", path, "err", err)
 				return nil // continue walking
 			}
 			if d.IsDir() {
 				if watched_folder.Contains(path) {
 					return nil
 				}
-				if err := watcher.Add(path); err != nil {
-					log.Printf("Failed to watch %s: %v", path, err)
+				if isIgnoredPath(config, path, true) {
+					return filepath.SkipDir
+				}
+				if err := watcher.Add(path); errors.Is(err, syscall.ENOSPC) {
+					// Out of inotify watches; the folders below would fail too
+					limitOnce.Do(func() {
+						slog.Warn("inotify watch limit reached, polling the remaining folders every poll_interval_seconds; " +
+							"raise it with sysctl fs.inotify.max_user_watches=524288 to watch every folder")
+					})
+					if poller.Add(path) {
+						slog.Debug("Polling directory", "path", path)
+					}
+					return filepath.SkipDir
+				} else if err != nil {
+					slog.Error("Watching directory failed", "path", path, "err", err)
 				} else {
-					log.Printf("Watching: %s", path)
+					slog.Debug("Watching directory", "path", path)
+					watched_folder.Add(path)
+					added = append(added, path)
 				}
 			}
 			return nil
 		})
+		metrics.watchedFolders.Store(int64(watched_folder.Cardinality()))
+		return added
+	}
+
+	// removeWatchersRecursive drops the watches on dir and every folder below
+	// it, returning the folders that were watched. After a move the kernel
+	// keeps watching the moved folders, but fsnotify would still report them
+	// under their old names.
+	removeWatchersRecursive := func(dir string) []string {
+		var removed []string
+		prefix := dir + string(filepath.Separator)
+		for _, path := range watched_folder.ToSlice() {
+			if path == dir || strings.HasPrefix(path, prefix) {
+				watcher.Remove(path)
+				watched_folder.Remove(path)
+				removed = append(removed, path)
+			}
+		}
+		metrics.watchedFolders.Store(int64(watched_folder.Cardinality()))
+		return removed
 	}
 
-	n_current = 0
 	addWatchersRecursive(config.WatchDir)
+	if !watched_folder.Contains(config.WatchDir) {
+		return fmt.Errorf("cannot watch %s", config.WatchDir)
+	}
+	polled := poller.Poll(config, db, ip, true)
+	slog.Info("Watching folders", "watched", watched_folder.Cardinality(), "polled", polled)
+	metrics.watching.Store(true)
+	defer func() {
+		metrics.watching.Store(false)
+		metrics.watchedFolders.Store(0)
+	}()
+
+	// Folders beyond the watch limit are rescanned instead
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Duration(config.PollIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				poller.Poll(config, db, ip, false)
+			}
+		}
+	}()
+	// Edits to files are coalesced per folder, so saving a batch of files
+	// rewrites the post once
+	var refreshMux sync.Mutex
+	refreshTimers := make(map[string]*time.Timer)
+	scheduleRefresh := func(dir string) {
+		refreshMux.Lock()
+		defer refreshMux.Unlock()
+		if t, ok := refreshTimers[dir]; ok {
+			t.Reset(fileChangeDelay)
+			return
+		}
+		refreshTimers[dir] = time.AfterFunc(fileChangeDelay, func() {
+			refreshMux.Lock()
+			delete(refreshTimers, dir)
+			refreshMux.Unlock()
+			refreshFolder(dir, config, db, ip)
+		})
+	}
+	defer func() {
+		refreshMux.Lock()
+		for _, t := range refreshTimers {
+			t.Stop()
+		}
+		refreshMux.Unlock()
+	}()
+
 	// exts := append(config.PhotoExts, config.VideoExts...)
 	wg.Add(1)
 	go func() {
@@ -71,11 +174,23 @@ func WatchFolders(config Config, db *sql.DB, tmpl *template.Template) {
 				if !ok {
 					return
 				}
+				metrics.watcherEvents.Add(1)
+				// A photo, video or description removed or renamed away
+				// refreshes its folder
+				if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 && (isMediaFile(config, event.Name) || isDescriptionFile(event.Name)) {
+					scheduleRefresh(filepath.Dir(event.Name))
+					continue
+				}
 				// Handle rename/move events specially
 				if event.Op&fsnotify.Rename != 0 {
-					// For renames, handle the deletion of old path
-					log.Printf("[DEBUG] Rename detected: %s", event.Name)
-					handleDeletedFolder(event.Name, config, db)
+					// For renames, handle the deletion of old path and of every
+					// folder moved along with it. The new path arrives as a
+					// Create event when it is inside WatchDir.
+					slog.Debug("Rename detected", "path", event.Name)
+					handleDeletedTree(event.Name, removeWatchersRecursive(event.Name), config, db)
+					if refreshAlbums(config, db, ip, event.Name) {
+						rebuildHugo(config)
+					}
 
 					// Give the OS time to complete the rename
 					time.Sleep(100 * time.Millisecond)
@@ -90,74 +205,77 @@ func WatchFolders(config Config, db *sql.DB, tmpl *template.Template) {
 						info, err := os.Stat(path)
 						if err != nil {
 							if !os.IsNotExist(err) {
-								log.Printf("Error stating %s: %v", path, err)
+								slog.Error("Stating path failed", "path", path, "err", err)
 							}
 							return
 						}
 
-						if info.IsDir() {
-							if config.Verbose {
-								log.Printf("[DEBUG] New directory detected: %s", path)
+						if !info.IsDir() {
+							if (isMediaFile(config, path) || isDescriptionFile(path)) && !isIgnoredPath(config, path, false) {
+								scheduleRefresh(filepath.Dir(path))
 							}
-							addWatchersRecursive(path)
-							handleNewFolderWithTemplate(path, config, db, tmpl, true, nil, nil)
+							return
+						}
+						if isIgnoredPath(config, path, true) {
+							return
+						}
+						slog.Debug("New directory detected", "path", path)
+						// A folder moved in brings its whole subtree along
+						for _, dir := range addWatchersRecursive(path) {
+							handleNewFolderWithTemplate(dir, config, dbStore{db}, ip, true, nil, nil)
+						}
+						if refreshAlbums(config, db, ip, path) {
+							rebuildHugo(config)
 						}
 					}(event.Name)
 				}
 				if event.Op&fsnotify.Remove == fsnotify.Remove {
 					if _, err := os.Stat(event.Name); os.IsNotExist(err) {
-						log.Printf("Deletion of directory detected: %s", event.Name)
-						handleDeletedFolder(event.Name, config, db)
+						slog.Info("Deletion of directory detected", "path", event.Name)
+						handleDeletedTree(event.Name, removeWatchersRecursive(event.Name), config, db)
+						if refreshAlbums(config, db, ip, event.Name) {
+							rebuildHugo(config)
+						}
 					}
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
-				log.Println("Watcher error:", err)
+				slog.Error("Watcher error", "err", err)
 			}
 		}
 	}()
 	wg.Wait()
+	return nil
 }
 
-func handleNewFolderWithTemplate(path string, config Config, db *sql.DB, tmpl *template.Template, rebuild bool, images []string, videos []string) {
+func handleNewFolderWithTemplate(path string, config Config, store postStore, ip *ImageProcessor, rebuild bool, images []string, videos []string) {
 	rel_path, err := filepath.Rel(config.WatchDir, path)
 	if err != nil {
-		log.Printf("Error getting relative path: %v", err)
+		slog.Error("Getting relative path failed", "path", path, "err", err)
 		return
 	}
 
 	// Single directory scan
 	files, err := os.ReadDir(path)
 	if err != nil {
-		log.Printf("Error reading folder %s: %v", path, err)
+		slog.Error("Reading folder failed", "path", path, "err", err)
 		return
 	}
 
 	// Process files in one pass
 	if len(images) == 0 {
-		images = make([]string, 0, len(files))
-		videos = make([]string, 0, len(files))
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			name := file.Name()
-			ext := strings.ToLower(filepath.Ext(name))
-
-			if isInSlice(ext, config.PhotoExts) {
-				images = append(images, name)
-			} else if isInSlice(ext, config.VideoExts) {
-				videos = append(videos, name)
-			}
-		}
-
+		images, videos = classifyMedia(config, newIgnoreMatcher(config), path, files, make([]string, 0, len(files)), make([]string, 0, len(files)))
 	}
 
 	totalFiles := len(images) + len(videos)
 	if totalFiles == 0 {
-		log.Printf("No media files found in %s, skipping.", path)
+		if children := albumChildren(config, path, files); len(children) > 0 {
+			writeAlbum(path, config, store, children, rebuild)
+			return
+		}
+		slog.Info("No media files found, skipping", "path", path)
 		return
 	}
 
@@ -167,100 +285,228 @@ func handleNewFolderWithTemplate(path string, config Config, db *sql.DB, tmpl *t
 	folderSHA := sha1Hex(path)
 
 	postFile := folderSHA + ".md"
-	postDir := filepath.Join(config.ContentDir, "post")
-	postPath := filepath.Join(postDir, postFile)
-
-	if err := os.MkdirAll(postDir, 0755); err != nil {
-		log.Printf("Error creating post directory: %v", err)
+	postDir, err := makePostDir(config, rel_path)
+	if err != nil {
+		slog.Error("Creating post directory failed", "err", err)
 		return
 	}
+	postPath := filepath.Join(postDir, postFile)
 
-	// Use file stat directly instead of separate call
-	fileInfo, err := os.Stat(path)
-	date := time.Now()
-	// set date to folder mod time if available
-	if err == nil {
-		date = fileInfo.ModTime()
-	}
+	date := postDate(config, path, images)
 
-	log.Printf("Generating post %s.md for %s", folderSHA, path)
-	mdContent := generateMarkdownWithTemplate(tmpl, images, videos, postname, folderSHA, tags, date)
+	cover := coverImage(images)
+	description := readDescription(path)
+	hash := contentHash(images, videos, description)
+	images, videos = capMedia(config, path, images, videos)
+	slog.Info("Generating post", "sha", folderSHA, "path", path)
+	mdContent := generateMarkdownWithTemplate(currentTemplate(), topCategory(categories), images, videos, mediaSizes(files, images), mediaSizes(files, videos),
+		postname, rel_path, folderSHA, cover, tags, date, description, totalFiles)
 
+	oldContent, _ := os.ReadFile(postPath)
 	if err := os.WriteFile(postPath, []byte(mdContent), 0644); err != nil {
-		log.Printf("Error writing markdown: %v", err)
+		slog.Error("Writing markdown failed", "sha", folderSHA, "err", err)
 		return
 	}
 
-	AddPost(db, folderSHA, postFile, strings.Join(categories, "/"), rel_path, totalFiles)
-	folderMap[folderSHA] = path
+	store.AddPost(Post{
+		FolderSHA:   folderSHA,
+		PostFile:    postFile,
+		Category:    strings.Join(categories, "/"),
+		Tags:        tags,
+		RelPath:     rel_path,
+		ParentSHA:   parentSHA(config, path),
+		NFile:       totalFiles,
+		Cover:       cover,
+		ContentHash: hash,
+		CreatedAt:   time.Now(),
+	})
+
+	if ip != nil {
+		ip.Precompute(path, imageRelPaths(rel_path, images))
+	}
 
 	if rebuild {
-		rebuildHugo(config)
+		rebuildForPost(config, postPath, string(oldContent), mdContent)
 	}
 }
 
-func updatePost(db *sql.DB, path string, images []string, videos []string, config Config, tmpl *template.Template) {
+func updatePost(store postStore, path string, images []string, videos []string, config Config) {
 	folderSHA := sha1Hex(path)
-	newNFile := len(images) + len(images)
+	newNFile := len(images) + len(videos)
 	rel_path, _ := filepath.Rel(config.WatchDir, path)
 	categories := getCategories(rel_path)
 	postname := filepath.Base(path)
 	tags := getTags(categories, postname)
 	postFile := folderSHA + ".md"
-	// postDir := filepath.Join(config.ContentDir, filepath.Join(categories...))
-	postDir := filepath.Join(config.ContentDir, "post")
-	postPath := filepath.Join(postDir, postFile)
-	if err := os.MkdirAll(postDir, 0755); err != nil {
-		log.Printf("Error creating post directory: %v", err)
+	postDir, err := makePostDir(config, rel_path)
+	if err != nil {
+		slog.Error("Creating post directory failed", "err", err)
 		return
 	}
+	postPath := filepath.Join(postDir, postFile)
 
-	date := time.Now()
-	{
-		info, err := os.Stat(path)
-		if err == nil {
-			date = info.ModTime()
+	if newNFile == 0 {
+		// A folder whose last media file went can still be an album
+		entries, _ := os.ReadDir(path)
+		if children := albumChildren(config, path, entries); len(children) > 0 {
+			writeAlbum(path, config, store, children, false)
+			return
 		}
 	}
 
-	UpdateNFile(db, folderSHA, path, newNFile)
+	date := postDate(config, path, images)
+
+	cover := coverImage(images)
+	description := readDescription(path)
+	store.UpdatePost(Post{
+		FolderSHA:   folderSHA,
+		Category:    strings.Join(categories, "/"),
+		Tags:        tags,
+		ParentSHA:   parentSHA(config, path),
+		NFile:       newNFile,
+		Cover:       cover,
+		ContentHash: contentHash(images, videos, description),
+		CreatedAt:   date,
+	})
 
 	if newNFile == 0 {
 		os.Remove(postPath)
-		RemovePost(db, folderSHA)
-		log.Printf("No media files left in %s, removed post and database record.", path)
+		store.RemovePost(folderSHA)
+		slog.Info("No media files left, removed post and database record", "sha", folderSHA, "path", path)
 		return
 	}
-	mdContent := generateMarkdownWithTemplate(tmpl, images, videos, filepath.Base(path), folderSHA, tags, date)
-	err := os.WriteFile(postPath, []byte(mdContent), 0644)
+	files, _ := os.ReadDir(path)
+	images, videos = capMedia(config, path, images, videos)
+	mdContent := generateMarkdownWithTemplate(currentTemplate(), topCategory(categories), images, videos, mediaSizes(files, images), mediaSizes(files, videos),
+		filepath.Base(path), rel_path, folderSHA, cover, tags, date, description, newNFile)
+	err = os.WriteFile(postPath, []byte(mdContent), 0644)
 	if err != nil {
-		log.Println("Error writing markdown:", err)
+		slog.Error("Writing markdown failed", "sha", folderSHA, "err", err)
 		return
 	}
 }
 
+// capMedia truncates a folder's media to max_files_per_post, keeping photos
+// before videos, and logs a warning when it does.
+func capMedia(config Config, path string, images, videos []string) ([]string, []string) {
+	limit := config.MaxFilesPerPost
+	if limit <= 0 || len(images)+len(videos) <= limit {
+		return images, videos
+	}
+	slog.Warn("Folder exceeds max_files_per_post, its post lists only the first files",
+		"path", path, "files", len(images)+len(videos), "max_files_per_post", limit)
+	if len(images) >= limit {
+		return images[:limit], nil
+	}
+	return images, videos[:limit-len(images)]
+}
+
+// coverImage returns the image shown for a post in listings: a file named
+// cover.* or folder.* if the folder has one, else the first image.
+func coverImage(images []string) string {
+	for _, name := range images {
+		switch strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name))) {
+		case "cover", "folder":
+			return name
+		}
+	}
+	if len(images) == 0 {
+		return ""
+	}
+	return images[0]
+}
+
+// isMediaFile reports whether path has a photo or video extension. With
+// sniff_content_type, a removed file without an extension counts as media,
+// since its content can no longer be checked.
+func isMediaFile(config Config, path string) bool {
+	ext := mediaExt(config, path)
+	if ext == "" && config.SniffContentType && filepath.Ext(path) == "" {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return true
+		}
+	}
+	return isInSlice(ext, config.PhotoExts) || isInSlice(ext, config.VideoExts)
+}
+
+// refreshFolder rewrites the post of a folder whose files were added,
+// modified or removed, and requests the matching Hugo build.
+func refreshFolder(path string, config Config, db *sql.DB, ip *ImageProcessor) {
+	if path == config.WatchDir {
+		// Files directly in watched_folder belong to no post
+		return
+	}
+	// The albums above show this folder's cover, and list it only while it
+	// has media
+	defer func() {
+		if refreshAlbums(config, db, ip, path) {
+			rebuildHugo(config)
+		}
+	}()
+	folderSHA := sha1Hex(path)
+	if GetRelPath(db, folderSHA) == "" {
+		// The first media file of a folder creates its post
+		handleNewFolderWithTemplate(path, config, dbStore{db}, ip, true, nil, nil)
+		return
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		// A removed folder is handled by its own event
+		if !os.IsNotExist(err) {
+			slog.Error("Reading folder failed", "path", path, "err", err)
+		}
+		return
+	}
+	images, videos := classifyMedia(config, newIgnoreMatcher(config), path, entries, nil, nil)
+	slog.Debug("Files changed, updating post", "sha", folderSHA, "path", path, "files", len(images)+len(videos))
+
+	rel_path, _ := filepath.Rel(config.WatchDir, path)
+	postPath := postFilePath(config, rel_path, folderSHA)
+	oldContent, _ := os.ReadFile(postPath)
+	updatePost(dbStore{db}, path, images, videos, config)
+	if len(images)+len(videos) == 0 {
+		rebuildHugo(config)
+		return
+	}
+	newContent, _ := os.ReadFile(postPath)
+	if ip != nil {
+		ip.Precompute(path, imageRelPaths(rel_path, images))
+	}
+	rebuildForPost(config, postPath, string(oldContent), string(newContent))
+}
+
+// handleDeletedTree removes the posts of path and of the watched folders
+// that were below it.
+func handleDeletedTree(path string, watched []string, config Config, db *sql.DB) {
+	handleDeletedFolder(path, config, db)
+	for _, dir := range watched {
+		if dir != path {
+			handleDeletedFolder(dir, config, db)
+		}
+	}
+}
+
 // Handle folder deletion
 func handleDeletedFolder(path string, config Config, db *sql.DB) {
 	folderSHA := sha1Hex(path)
-	var postFile, category string
-	row := db.QueryRow("SELECT post_filename, category FROM posts WHERE folder_sha = ?", folderSHA)
-	row.Scan(&postFile, &category)
-	delete(folderMap, folderSHA)
-	postPath := filepath.Join(config.ContentDir, "post", postFile)
+	var postFile, relPath string
+	row := db.QueryRow("SELECT post_filename, rel_path FROM posts WHERE folder_sha = ?", folderSHA)
+	row.Scan(&postFile, &relPath)
+	postPath := filepath.Join(postDir(config, relPath), postFile)
 	// check if file exists before removing
 	if postFile != "" {
 		if _, err := os.Stat(postPath); err == nil {
-			log.Printf("[DEBUG] Removing post file: %s", postPath)
+			slog.Debug("Removing post file", "sha", folderSHA, "path", postPath)
 			os.Remove(postPath)
 		} else {
-			log.Printf("[DEBUG] Post file %s does not exist, skipping removal.", postPath)
+			slog.Debug("Post file does not exist, skipping removal", "sha", folderSHA, "path", postPath)
 		}
 		RemovePost(db, folderSHA)
 		rebuildHugo(config)
 	}
 }
 
-// List images in folder sorted human-friendly
+// List images in folder in natural order
 func listImages(folder string, exts []string) []string {
 	entries, _ := os.ReadDir(folder)
 	var imgs []string
@@ -273,9 +519,7 @@ func listImages(folder string, exts []string) []string {
 			}
 		}
 	}
-	sort.Slice(imgs, func(i, j int) bool {
-		return imgs[i] < imgs[j] // simple ASCII sort
-	})
+	sortNatural(imgs)
 	return imgs
 }
 
@@ -285,6 +529,14 @@ func sha1Hex(s string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// topCategory returns the first category, "" for top-level folders.
+func topCategory(categories []string) string {
+	if len(categories) == 0 {
+		return ""
+	}
+	return categories[0]
+}
+
 func getCategories(rel string) []string {
 	rel = filepath.Dir(rel)
 	if rel == "." || rel == "" {
@@ -293,15 +545,62 @@ func getCategories(rel string) []string {
 	return strings.Split(rel, string(os.PathSeparator))
 }
 
-// Get or create Jieba instance
+// Words never used as tags unless tag_skip_words is set.
+var defaultTagSkipWords = []string{"MB", "GB", "作品", "写真", "写真集", "原创", "原創", "订阅"}
+
+// Words Jieba keeps whole unless jieba_user_words is set.
+var defaultJiebaUserWords = []string{"夏夏子"}
+
+// Get or create Jieba instance. The vocabulary is read from the config on
+// first use, so changing it needs a restart.
 func getJieba() *gojieba.Jieba {
 	jiebaOnce.Do(func() {
-		jiebaSingleton = gojieba.NewJieba()
-		jiebaSingleton.AddWord("夏夏子")
+		config := currentConfig()
+		// Empty paths keep gojieba's bundled dictionaries
+		jiebaSingleton = gojieba.NewJieba("", "", config.JiebaUserDict)
+		for _, word := range config.JiebaUserWords {
+			jiebaSingleton.AddWord(word)
+		}
 	})
 	return jiebaSingleton
 }
 
+// getTagSkipSet returns tag_skip_words as a set, built on first use.
+func getTagSkipSet() map[string]struct{} {
+	tagSkipOnce.Do(func() {
+		config := currentConfig()
+		tagSkipSet = make(map[string]struct{}, len(config.TagSkipWords))
+		for _, word := range config.TagSkipWords {
+			tagSkipSet[word] = struct{}{}
+		}
+	})
+	return tagSkipSet
+}
+
+// readWordList reads one word per line, skipping blank lines and lines
+// starting with #.
+func readWordList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, nil
+}
+
+// Words of a folder name that are never tags: numbering such as "P12" or
+// "3V", and "part..." words.
+var (
+	reStartWithNumber = regexp.MustCompile(`^P?\d+V?`)
+	reStartWithPart   = regexp.MustCompile(`^part`)
+)
+
 func getTags(categories []string, postname string) []string {
 	filtered := make([]string, 0, len(categories))
 	for _, c := range categories {
@@ -311,18 +610,11 @@ func getTags(categories []string, postname string) []string {
 	}
 
 	if utf8.RuneCountInString(postname) > 3 {
-		jb := getJieba() // Use singleton instance
-		words := jb.Cut(postname, true)
+		words := tokenize(currentConfig(), postname)
+		skipSet := getTagSkipSet()
 		// log.Printf("Jieba cut for %s: %v", postname, strings.Join(words, "/"))
 
 		asciiSymbols := `!"#$%&'()*+,-./:;<=>?@[\]^_{|}~`
-		reStartWithNumber := regexp.MustCompile(`^P?\d+V?`)
-		reStartWithPart := regexp.MustCompile(`^part`)
-		skipWords := []string{"MB", "GB", "作品", "写真", "写真集", "原创", "原創", "订阅"}
-		skipSet := make(map[string]struct{}, len(skipWords))
-		for _, w := range skipWords {
-			skipSet[w] = struct{}{}
-		}
 		for _, c := range words {
 			if _, skip := skipSet[c]; skip {
 				continue
@@ -347,39 +639,13 @@ func getTags(categories []string, postname string) []string {
 			result = append(result, tag)
 		}
 	}
-
-	return filtered
-}
-
-func rebuildHugo(config Config) {
-	mu.Lock()
-	n_current++
-	my := n_current
-	mu.Unlock()
-
-	if my != 1 {
-		mu.Lock()
-		n_current--
-		mu.Unlock()
-	} else {
-		for {
-			mu.Lock()
-			if n_current <= 1 {
-				mu.Unlock()
-				break
-			}
-			mu.Unlock()
-			time.Sleep(5 * time.Second)
-		}
-		log.Printf("Start building at %v", time.Now())
-		cmd := exec.Command(config.HugoPath, "--source", ".", "--destination", config.HugoOutDir)
-		cmd.Run()
-
-		mu.Lock()
-		n_current--
-		mu.Unlock()
+	// Categories come first, then words in name order, so truncating keeps
+	// the broadest tags
+	if maxTags := currentConfig().MaxTags; maxTags > 0 && len(result) > maxTags {
+		result = result[:maxTags]
 	}
 
+	return result
 }
 
 func cleanupJieba() {
@@ -389,12 +655,18 @@ func cleanupJieba() {
 }
 
 func houseKeeping(config Config, db *sql.DB) {
+	defer func() {
+		metrics.housekeepingRuns.Add(1)
+		metrics.lastHousekeepingUnix.Store(time.Now().Unix())
+	}()
+
 	// Initialize the map
 	records := make(map[string]string)
+	ignore := newIgnoreMatcher(config)
 
 	rows, err := db.Query("SELECT folder_sha, rel_path FROM posts")
 	if err != nil {
-		log.Printf("Error querying posts: %v", err)
+		slog.Error("Querying posts failed", "err", err)
 		return
 	}
 	defer rows.Close()
@@ -403,45 +675,75 @@ func houseKeeping(config Config, db *sql.DB) {
 	for rows.Next() {
 		var postID, relPath string
 		if err := rows.Scan(&postID, &relPath); err != nil {
-			log.Printf("Error scanning row: %v", err)
+			slog.Error("Scanning row failed", "err", err)
 			continue
 		}
 		absPath := filepath.Join(config.WatchDir, relPath)
 		if _, err := os.Stat(absPath); os.IsNotExist(err) {
 			// folder does not exist, remove from db
-			log.Printf("Folder %s does not exist, removing from db", absPath)
+			slog.Info("Folder does not exist, removing from db", "sha", postID, "path", absPath)
 			err := RemovePost(db, postID)
 			if err != nil {
-				log.Printf("Error removing post %s: %v", postID, err)
+				slog.Error("Removing post failed", "sha", postID, "err", err)
+			}
+		} else if ignore.ignoredPath(absPath, true) {
+			// folder excluded by .galleryignore, remove from db
+			slog.Info("Folder is ignored, removing from db", "sha", postID, "path", absPath)
+			if err := RemovePost(db, postID); err != nil {
+				slog.Error("Removing post failed", "sha", postID, "err", err)
 			}
 		} else {
 			records[postID] = relPath
 		}
 	}
 	if err := rows.Err(); err != nil {
-		log.Printf("Row iteration error: %v", err)
+		slog.Error("Row iteration failed", "err", err)
 		return
 	}
 
-	// Delete orphaned post files
-	postDir := filepath.Join(config.ContentDir, "post")
-	err = filepath.Walk(postDir, func(path string, info fs.FileInfo, err error) error {
+	// Delete orphaned post files, and move those written with another
+	// post_layout to where the current one puts them
+	err = filepath.Walk(config.ContentDir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
-			log.Printf("Error walking path %s: %v", path, err)
+			slog.Error("Walking path failed", "path", path, "err", err)
 			return nil
 		}
-		if info != nil && !info.IsDir() && strings.HasSuffix(info.Name(), ".md") {
-			postID := strings.TrimSuffix(info.Name(), ".md")
-			if _, exists := records[postID]; !exists {
-				// post_id not in db, delete the file
-				log.Printf("Removing orphaned post file: %s", path)
-				os.Remove(path)
-			}
+		if info == nil || info.IsDir() || !isPostFile(config, path) {
+			return nil
+		}
+		postID := strings.TrimSuffix(info.Name(), ".md")
+		relPath, exists := records[postID]
+		if !exists {
+			// post_id not in db, delete the file
+			slog.Info("Removing orphaned post file", "path", path)
+			os.Remove(path)
+			return nil
+		}
+		if want := postFilePath(config, relPath, postID); path != want {
+			relocatePost(config, relPath, path, want)
 		}
 		return nil
 	})
 	if err != nil {
-		log.Printf("Error walking post directory: %v", err)
+		slog.Error("Walking post directory failed", "err", err)
+	}
+}
+
+// relocatePost moves the post file at path to want, or removes it when a
+// post was already written there.
+func relocatePost(config Config, relPath, path, want string) {
+	if _, err := os.Stat(want); err == nil {
+		slog.Info("Removing duplicate post file", "path", path, "post", want)
+		os.Remove(path)
+		return
+	}
+	if _, err := makePostDir(config, relPath); err != nil {
+		slog.Error("Creating post directory failed", "err", err)
+		return
+	}
+	slog.Info("Moving post file to the post_layout folder", "from", path, "to", want)
+	if err := os.Rename(path, want); err != nil {
+		slog.Error("Moving post file failed", "path", path, "err", err)
 	}
 }
 
@@ -449,9 +751,9 @@ func startHouseKeeping(config Config, db *sql.DB, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			log.Println("Starting housekeeping...")
+			slog.Info("Starting housekeeping")
 			houseKeeping(config, db)
-			log.Println("Housekeeping completed.")
+			slog.Info("Housekeeping completed")
 		}
 	}()
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func storedNFile(t *testing.T, g *testGallery, folderSHA string) int {
+	t.Helper()
+	var n int
+	if err := g.db.QueryRow("SELECT n_file FROM posts WHERE folder_sha = ?", folderSHA).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUpdatePostCountsImagesAndVideos(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 8, 8, color.White)
+	sha := g.addFolder(t, "Trip", map[string][]byte{
+		"a.jpg": jpg, "b.jpg": jpg,
+		"c.mp4": nil, "d.mp4": nil, "e.mp4": nil,
+	})
+	if _, err := g.db.Exec("UPDATE posts SET n_file = 0 WHERE folder_sha = ?", sha); err != nil {
+		t.Fatal(err)
+	}
+	updatePost(dbStore{g.db}, filepath.Join(g.config.WatchDir, "Trip"),
+		[]string{"a.jpg", "b.jpg"}, []string{"c.mp4", "d.mp4", "e.mp4"}, g.config)
+	if got := storedNFile(t, g, sha); got != 5 {
+		t.Errorf("n_file = %d, want 5", got)
+	}
+}
+
+func TestGetTagsDedupKeepsFirstSeenOrder(t *testing.T) {
+	setLiveConfig(t, Config{TagLanguage: "en"})
+	tests := []struct {
+		categories []string
+		postname   string
+		want       []string
+	}{
+		{nil, "kyoto temple kyoto garden temple", []string{"kyoto", "temple", "garden"}},
+		{[]string{"Travel", "kyoto"}, "temple kyoto Travel garden", []string{"Travel", "kyoto", "temple", "garden"}},
+		{[]string{"Travel", "Travel"}, "Travel", []string{"Travel"}},
+		{nil, "P12 part2 kyoto 2024 kyoto", []string{"kyoto"}},
+	}
+	for _, tt := range tests {
+		got := getTags(tt.categories, tt.postname)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getTags(%q, %q) = %q, want %q", tt.categories, tt.postname, got, tt.want)
+		}
+	}
+}
+
+// TestServeWhileFoldersChange serves photos while the watcher adds and
+// removes their folders; run it with -race.
+func TestServeWhileFoldersChange(t *testing.T) {
+	g := newTestGallery(t)
+	jpg := testJPEG(t, 8, 8, color.White)
+	var paths []string
+	for i := range 4 {
+		dir := filepath.Join(g.config.WatchDir, fmt.Sprintf("F%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "a.jpg"), jpg, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, dir)
+	}
+	h := handleImages(g.config, g.db, g.ip)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 40; i++ {
+			path := paths[i%len(paths)]
+			if i%2 == 0 {
+				handleNewFolderWithTemplate(path, g.config, dbStore{g.db}, nil, false, nil, nil)
+			} else {
+				RemovePost(g.db, sha1Hex(path))
+			}
+		}
+		close(done)
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				u := "/images/" + sha1Hex(paths[i%len(paths)]) + "/a.jpg"
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+				if rec.Code != http.StatusOK && rec.Code != http.StatusNotFound {
+					t.Errorf("GET %s = %d, want 200 or 404", u, rec.Code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetTagsMaxTags(t *testing.T) {
+	categories := []string{"Travel", "Japan"}
+	postname := "kyoto temple garden autumn"
+	tests := []struct {
+		maxTags int
+		want    []string
+	}{
+		{0, []string{"Travel", "Japan", "kyoto", "temple", "garden", "autumn"}},
+		{1, []string{"Travel"}},
+		{3, []string{"Travel", "Japan", "kyoto"}},
+		{6, []string{"Travel", "Japan", "kyoto", "temple", "garden", "autumn"}},
+		{10, []string{"Travel", "Japan", "kyoto", "temple", "garden", "autumn"}},
+	}
+	for _, tt := range tests {
+		setLiveConfig(t, Config{TagLanguage: "en", MaxTags: tt.maxTags})
+		if got := getTags(categories, postname); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("max_tags %d: getTags = %q, want %q", tt.maxTags, got, tt.want)
+		}
+	}
+}